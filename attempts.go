@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// A CaptureAttempt records a capture of a cache entry, be it successful or not.
+// The most recent attempts of an entry are kept in its Attempts (newest first),
+// which holds up to captureHistorySize attempts.
+type CaptureAttempt struct {
+	Time time.Time
+	// Mode is "fast" for captures made while a request waits, and "slow" for
+	// refreshes
+	Mode string
+	// DecapStatus is the status of the Decap response, or 0 if Decap couldn't
+	// be reached
+	DecapStatus int
+	// Error is the class of the error (see errorClass), or empty if the
+	// capture succeeded
+	Error    string
+	Duration time.Duration
+}
+
+// errorClass returns the class of a capture error, so that attempts can be
+// compared without the details of their error messages.
+func errorClass(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, croppingError):
+		return "cropping"
+	case errors.Is(err, decapInternalError):
+		return "decap_internal"
+	case errors.Is(err, decapRequestError):
+		return "decap_request"
+	default:
+		return "other"
+	}
+}
+
+func (a CaptureAttempt) String() string {
+	outcome := "ok"
+	if a.Error != "" {
+		outcome = a.Error
+	}
+	status := "unreachable"
+	if a.DecapStatus != 0 {
+		status = fmt.Sprint(a.DecapStatus)
+	}
+	return fmt.Sprintf("%s: %s, %s mode, Decap %s, %s",
+		formatDate(a.Time), outcome, a.Mode, status, a.Duration.Round(time.Millisecond))
+}
+
+// addAttempt adds a to the capture history of e.
+func (e *CacheEntry) addAttempt(a CaptureAttempt) {
+	e.Attempts = append([]CaptureAttempt{a}, e.Attempts...)
+	if len(e.Attempts) > captureHistorySize {
+		e.Attempts = e.Attempts[:captureHistorySize]
+	}
+}
+
+// entryHandler serves the cache entry of the URL given by the "url" query
+// param as JSON, in the same form as it's persisted.
+func entryHandler(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	targetURL, err := url.Parse(req.FormValue("url"))
+	if err != nil || targetURL.String() == "" {
+		http.Error(w, `Query param "url" must be a valid URL`, http.StatusBadRequest)
+		return
+	}
+	entry := cache.Read(cacheKey(targetURL))
+	if entry.IsEmpty() {
+		http.Error(w, errNotCached.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newEntryRecord(entry))
+}
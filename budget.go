@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+var errDecapBudget = errors.New("Decap budget exhausted")
+
+// The Decap budget limits the rate of captures, so that traffic spikes don't
+// overload the browser pool of Decap. Captures made while a request waits
+// (interactive ones) and refreshes (background ones) draw from separate
+// buckets, so that neither can starve the other. A nil bucket is unlimited.
+var interactiveBudget, backgroundBudget *tokenBucket
+
+// newDecapBudget returns the interactive and background buckets for a budget
+// of rate captures per minute with bursts of up to burst captures, of which
+// backgroundShare percent is reserved for background work. A rate of 0 means
+// that captures are unlimited.
+func newDecapBudget(rate, burst float64, backgroundShare int) (interactive, background *tokenBucket) {
+	if rate <= 0 {
+		return nil, nil
+	}
+	share := float64(backgroundShare) / 100
+	return newTokenBucket(rate*(1-share), burst*(1-share)), newTokenBucket(rate*share, burst*share)
+}
+
+// A tokenBucket allows an average of rate actions per minute, in bursts of up
+// to size actions. It's safe for concurrent use.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	size   float64
+	tokens float64
+	last   time.Time
+	denied int64
+}
+
+// newTokenBucket returns a full bucket. Its size is at least 1, so that a
+// small share of the budget still allows some actions.
+func newTokenBucket(rate, size float64) *tokenBucket {
+	size = math.Max(size, 1)
+	return &tokenBucket{rate: rate, size: size, tokens: size, last: time.Now()}
+}
+
+// refill adds the tokens earned since the last refill. The caller must hold
+// b.mu.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens = math.Min(b.size, b.tokens+now.Sub(b.last).Minutes()*b.rate)
+	b.last = now
+}
+
+// take takes a token if there is one, and reports whether it did.
+func (b *tokenBucket) take() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		b.denied++
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wait takes a token, waiting for one if the bucket is empty.
+func (b *tokenBucket) wait() {
+	if b == nil {
+		return
+	}
+	for {
+		b.mu.Lock()
+		b.refill()
+		if b.tokens >= 1 {
+			b.tokens--
+			b.mu.Unlock()
+			return
+		}
+		delay := time.Duration((1 - b.tokens) / b.rate * float64(time.Minute))
+		b.mu.Unlock()
+		time.Sleep(delay)
+	}
+}
+
+// String summarizes the bucket for the info page.
+func (b *tokenBucket) String() string {
+	if b == nil {
+		return "unlimited"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	return fmt.Sprintf("%.1f of %.0f left (%.1f/min), %d denied", b.tokens, b.size, b.rate, b.denied)
+}
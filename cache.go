@@ -3,19 +3,39 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
-	"time"
 	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jobindex/spectura/xlib"
 )
 
-// A CacheEntry wraps a PNG-encoded image to stored in a Cache. The screenshot
-// URL is used as the cache key.
+// A CacheEntry wraps a PNG-encoded image to stored in a Cache. A canonical
+// form of the screenshot URL is used as the cache key (see cacheKey). The
+// image is identified by ImageHash, which lets entries with identical
+// screenshots share a single copy of the image.
+//
+// When the image of an entry is replaced, the previous image is kept in
+// Versions (newest first), which holds up to imageHistorySize images.
+//
+// FailedAttempts counts the captures of the entry that have failed in a row,
+// the last one with LastError. Failed captures are retried with an
+// exponential backoff (see NextRefresh).
+//
+// A Pinned entry keeps its image: It isn't refreshed, and merge never
+// replaces its image. Neither is it cleared or evicted, until it's unpinned or
+// expires.
+//
+// Once Expire has passed, the entry is marked as expired by setting ExpiredAt.
+// Expired entries are no longer refreshed, and their image is freed after
+// expiredGracePeriod.
 type CacheEntry struct {
 	Expire             time.Time
 	Image              []byte
@@ -23,51 +43,118 @@ type CacheEntry struct {
 	URL                *url.URL
 	EntryCreated       time.Time
 	ImageCreated       time.Time
+	LastCaptured       time.Time
 	LastRefreshAttempt time.Time
 	LastFetched        time.Time
 	Provenance         Provenance
 	Score              int
+	ImageHash          string
+	Crop               CropParams
+	Versions           []ImageVersion
+	ExpiredAt          time.Time
+	FailedAttempts     int
+	LastError          string
+	Pinned             bool
+	Namespace          string
+	Tags               []string
+	Captures           int
+	Changes            int
+	RefreshInterval    time.Duration
+	Attempts           []CaptureAttempt
+	// captured is set if the image was captured for this entry, rather than
+	// shared with another capture or imported (see capture)
+	captured bool
 }
 
+var errNotCached = errors.New("URL is not cached")
+
 // IsEmpty reports whether e is a zero value CacheEntry.
 func (e *CacheEntry) IsEmpty() bool {
-	return e.Image == nil && e.Signature == "" && e.URL == nil
+	return e.ImageHash == "" && e.Signature == "" && e.URL == nil
 }
 
 func (e *CacheEntry) IsFailedImage() bool {
-	return e.URL != nil && e.Image == nil
+	return e.URL != nil && e.ImageHash == ""
+}
+
+// IsExpired reports whether e has been marked as expired.
+func (e *CacheEntry) IsExpired() bool {
+	return !e.ExpiredAt.IsZero()
+}
+
+// adoptSigned takes the signed fields of new, and reports whether it did. The
+// Expire and Signature of new are taken if its Expire is later, which comes
+// from a newer signed URL. Since variants of a URL share a cache entry, that's
+// only the case if the signature of new is for the same URL, namespace and
+// tags as that of e, so that it stays valid for e. If e has no namespace and
+// tags, but new does, e takes the URL, Namespace and Tags of new as well, so
+// that entries created without them, e.g. by warm-up, can be tagged later.
+func (e *CacheEntry) adoptSigned(new CacheEntry) bool {
+	switch {
+	case new.URL == nil:
+		return false
+	case e.Namespace == "" && len(e.Tags) == 0 && (new.Namespace != "" || len(new.Tags) > 0):
+		e.URL, e.Namespace, e.Tags = new.URL, new.Namespace, new.Tags
+	case !new.Expire.After(e.Expire) || new.signedURL() != e.signedURL():
+		return false
+	}
+	e.Expire, e.Signature = new.Expire, new.Signature
+	return true
 }
 
 // merge takes an "old" and a "new" CacheEntry, and creates a copy of the old
 // entry where some fields may have been overwritten by values from the newer
 // entry. It uses the following rules when merging:
 //
-// Expire and URL are always kept as is.
+// URL, Namespace, Tags, Expire and Signature, which a signature covers
+// together, are kept unless adoptSigned takes them from new: Expire and
+// Signature are replaced by a later Expire signed for the same URL, namespace
+// and tags, and an entry without a namespace and tags takes all of them from
+// a new entry that has some. If Expire is then in the future, the entry is no
+// longer expired.
 //
-// If the new Image is non-nil, the new image is different to the old image
-// and the score is not signifcantly lower; both Image and Score are overwritten,
-// and ImageCreated is set to the time of the merge.
-// Otherwise old's Image and Score are kept.
+// If old is not pinned, the new ImageHash is non-empty, the new image is
+// different to the old image and the score is not signifcantly lower; Image,
+// ImageHash, Score and Crop are overwritten, ImageCreated is set to the time of
+// the merge, and the old image is added to Versions.
+// Otherwise old's image fields are kept.
+//
+// If old already had an image and new was captured rather than shared or
+// imported, the new image counts as a capture towards the change history,
+// which adapts the refresh interval (see adaptRefreshInterval). That way, a
+// capture is counted once, however many callers share it.
+// LastCaptured is set to the time of the merge whenever the new image is used
+// or is the same as the old one, so that images that never change stay fresh.
 //
 // If EntryCreated, Provenance or Signature were empty, they are taken from new,
 // otherwise the old values are used.
 //
 // The newest value of LastFetched is used.
 func merge(old, new CacheEntry) CacheEntry {
-	if new.Image != nil {
+	if new.ImageHash != "" && !old.Pinned {
+		hadImage, changed := old.ImageHash != "", false
 		if new.Score < old.Score/2 || new.Score < old.Score-20 {
 			// Ignore new image because of signifcant information densitiy loss
-		} else if bytes.Compare(new.Image, old.Image) != 0 {
+		} else if new.ImageHash != old.ImageHash {
 			// Use new image if it's different
+			old.setVersion(ImageVersion{new.ImageHash, new.Score, time.Now(), new.Crop})
 			old.Image = new.Image
-			old.ImageCreated = time.Now()
-			old.Score = new.Score
-			go webhook("image_updated", old)
+			changed = true
+			sendWebhook("image_updated", old)
+		}
+		if changed || new.ImageHash == old.ImageHash {
+			old.LastCaptured = time.Now()
+		}
+		if hadImage && new.captured {
+			old.adaptRefreshInterval(changed)
 		}
 	}
 	if old.Provenance.when.IsZero() {
 		old.Provenance = new.Provenance
 	}
+	if old.adoptSigned(new) && time.Now().Before(old.Expire) {
+		old.ExpiredAt = time.Time{}
+	}
 	if old.Signature == "" {
 		old.Signature = new.Signature
 	}
@@ -83,154 +170,468 @@ func merge(old, new CacheEntry) CacheEntry {
 	return old
 }
 
-// A Cache is an in-memory key-value store of recently accessed CacheEntry
-// values. A new (zero value) Cache must be initialized before use (see Init).
-// Caches are safe for concurrent use by multiple goroutines.
+// A Cache is a key-value store of recently accessed CacheEntry values, kept in
+// a pluggable CacheStore. A new (zero value) Cache must be initialized before
+// use (see Init). Caches are safe for concurrent use by multiple goroutines.
 //
-// An entry that hasn't been requested for 12 hours is deleted from the Cache.
+// An entry is deleted from the Cache once its EvictionPolicy says so. If the
+// images in the Cache grow beyond maxCacheSize, the least recently fetched
+// entries are evicted until the Cache fits its budget again. Pinned entries are
+// exempt from both, until they expire. Since images are shared between entries
+// with identical screenshots, the size of the Cache is the total size of its
+// distinct images.
 type Cache struct {
-	entries               map[string]CacheEntry
-	fallbackImage         []byte
-	readQuery             chan string
-	readReply, writeQuery chan CacheEntry
-	readAllQuery          chan struct{}
-	readAllReply          chan []CacheEntry
-	refreshQueue          chan chan struct{}
+	// mu guards the fields below it. Writers hold it while merging an entry
+	// into the store, so that merges and image reference counts stay
+	// consistent, while readers share it.
+	mu            sync.RWMutex
+	store         CacheStore
+	images        map[string]imageRef
+	size          int
+	fallbackImage []byte
+
+	evictions    atomic.Int64
+	refreshQueue *refreshQueue
+	hostLimits   *hostLimits
+	captures     flightGroup
+	// tasks tracks the running refreshes
+	tasks sync.WaitGroup
+
+	refreshingMu sync.Mutex
+	refreshing   map[string]bool
 }
 
 // Init initializes an existing Cache value for use through the Read and Write
-// methods.
-func (c *Cache) Init() {
+// methods, keeping its entries in the given store, and starts its background
+// jobs.
+func (c *Cache) Init(store CacheStore) {
+	c.initStore(store)
+	go c.initFallbackImage()
+	go c.schedule()
+	go c.scheduleRefresh()
+}
+
+// initStore initializes c with the entries in store, without starting any
+// background jobs.
+func (c *Cache) initStore(store CacheStore) {
 	*c = Cache{
-		entries:       make(map[string]CacheEntry),
+		store:         store,
+		images:        make(map[string]imageRef),
 		fallbackImage: encodeEmptyPNG(OGImageWidth, OGImageHeight),
-		readQuery:     make(chan string),
-		readReply:     make(chan CacheEntry),
-		writeQuery:    make(chan CacheEntry),
-		readAllQuery:  make(chan struct{}),
-		readAllReply:  make(chan []CacheEntry),
-		refreshQueue:  make(chan chan struct{}, 10),
+		refreshQueue:  newRefreshQueue(refreshQueueSize),
+		hostLimits:    newHostLimits(),
+		refreshing:    make(map[string]bool),
 	}
-	go c.initFallbackImage()
-	go c.serve()
-	go c.scheduleRefresh()
+	store.Range(func(_ string, entry CacheEntry) bool {
+		for _, hash := range entry.imageHashes() {
+			c.retainImage(hash, nil)
+		}
+		return true
+	})
 }
 
+// ReadAll returns every entry in the cache.
 func (c *Cache) ReadAll() []CacheEntry {
-	c.readAllQuery <- struct{}{}
-	return <-c.readAllReply
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	res := make([]CacheEntry, 0, c.store.Len())
+	c.store.Range(func(_ string, entry CacheEntry) bool {
+		entry.Image, _ = c.store.GetImage(entry.ImageHash)
+		res = append(res, entry)
+		return true
+	})
+	return res
+}
+
+// Read returns the CacheEntry value at the given key in the cache (see
+// cacheKey). If no entry was found, a zero value entry is returned.
+func (c *Cache) Read(key string) CacheEntry {
+	if remote, ok := c.store.(remoteStore); ok {
+		c.readThrough(remote, key)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	entry, _ := c.store.Get(key)
+	if entry.ImageHash != "" {
+		entry.Image, _ = c.store.GetImage(entry.ImageHash)
+	}
+	if entry.IsFailedImage() {
+		entry.Image = c.fallbackImage
+	}
+	return entry
 }
 
-// Read returns the CacheEntry value at the given URL in the cache. If no entry
-// was found, a zero value entry is returned.
-func (c *Cache) Read(url string) CacheEntry {
-	c.readQuery <- url
-	return <-c.readReply
+// readThrough adds the entry at key to the cache from remote, if it was
+// stored there by another instance.
+func (c *Cache) readThrough(remote remoteStore, key string) {
+	c.mu.RLock()
+	_, exists := c.store.Get(key)
+	c.mu.RUnlock()
+	if exists {
+		return
+	}
+	entry, ok := remote.Fetch(key)
+	if !ok {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, exists = c.store.Get(key); !exists {
+		c.put(key, CacheEntry{}, entry, nil)
+		c.enforceBudget(key)
+	}
 }
 
-// Write writes a CacheEntry to the cache, using entry.URL as the key.
+// ReadImage returns the stored image with the given hash.
+func (c *Cache) ReadImage(hash string) ([]byte, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if _, exists := c.images[hash]; !exists {
+		return nil, false
+	}
+	return c.store.GetImage(hash)
+}
+
+// Write writes a CacheEntry to the cache, using entry.Key() as the key.
 //
-// If the entry already exists, the cached image is overwritten. The client is
-// responsible for avoiding wasteful updates (i.e. overwriting an image with an
-// identical one).
+// If the entry already exists, it's merged with the existing entry (see
+// merge), which only replaces the cached image if it differs from the new one.
 func (c *Cache) Write(entry CacheEntry) {
-	c.writeQuery <- entry
+	if entry.Image != nil && entry.ImageHash == "" {
+		entry.ImageHash = imageHash(entry.Image)
+	}
+	c.write(entry, nil)
 }
 
-// WriteMetadata writes a CacheEntry's metadata to the cache, using entry.URL as
-// the key.
+// WriteMetadata writes a CacheEntry's metadata to the cache, using entry.Key()
+// as the key.
 func (c *Cache) WriteMetadata(entry CacheEntry) {
 	entry.Image = nil
-	c.writeQuery <- entry
+	entry.ImageHash = ""
+	c.write(entry, nil)
 }
 
-func (c *Cache) serve() {
-	// Interval for garbage collection and refresh checking
-	scheduleClock := time.NewTicker(scheduleInterval)
-	for {
-		select {
+// write merges entry into the cache. Images referenced by the entry's version
+// history that aren't stored yet must be present in images.
+func (c *Cache) write(entry CacheEntry, images map[string][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := entry.Key()
+	oldEntry, exists := c.store.Get(key)
+	if exists {
+		entry = merge(oldEntry, entry)
+	} else {
+		// Timestamps are kept if set, e.g. by a snapshot import
+		now := time.Now()
+		if entry.EntryCreated.IsZero() {
+			entry.EntryCreated = now
+		}
+		if entry.ImageHash != "" && entry.ImageCreated.IsZero() {
+			entry.ImageCreated = now
+		}
+		if entry.ImageHash != "" && entry.LastCaptured.IsZero() {
+			entry.LastCaptured = entry.ImageCreated
+		}
+		sendWebhook("image_created", entry)
+	}
+	c.put(key, oldEntry, entry, images)
+	c.enforceBudget(key)
+}
 
-		case <-c.readAllQuery:
-			res := make([]CacheEntry, 0, len(c.entries))
-			for _, entry := range c.entries {
-				res = append(res, entry)
-			}
-			c.readAllReply <- res
+// update applies fn to the entry at key and stores the result, unless fn
+// returns false. It reports whether an entry was found at key.
+func (c *Cache) update(key string, fn func(e *CacheEntry) bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, exists := c.store.Get(key)
+	if !exists {
+		return false
+	}
+	oldEntry := entry
+	if fn(&entry) {
+		c.put(key, oldEntry, entry, nil)
+	}
+	return true
+}
 
-		case url := <-c.readQuery:
-			entry, exists := c.entries[url]
-			replyEntry := entry
-			if entry.IsFailedImage() {
-				replyEntry.Image = c.fallbackImage
-			}
-			c.readReply <- replyEntry
-			if exists {
-				c.entries[url] = entry
-			}
+// put stores entry at key, replacing oldEntry, and updates the image
+// references accordingly. Images that aren't stored yet are taken from
+// entry.Image or images. The caller must hold c.mu.
+func (c *Cache) put(key string, oldEntry, entry CacheEntry, images map[string][]byte) {
+	// New references are added before old ones are removed, so images
+	// referenced by both entries are never deleted.
+	for _, hash := range entry.imageHashes() {
+		if hash == entry.ImageHash && entry.Image != nil {
+			c.retainImage(hash, entry.Image)
+		} else {
+			c.retainImage(hash, images[hash])
+		}
+	}
+	for _, hash := range oldEntry.imageHashes() {
+		c.releaseImage(hash)
+	}
+	entry.Image = nil
+	if err := c.store.Put(key, entry); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't store cache entry %s: %s\n", entry.URL, err)
+	}
+}
 
-		case entry := <-c.writeQuery:
-			if oldEntry, exists := c.entries[entry.URL.String()]; exists {
-				entry = merge(oldEntry, entry)
-			} else {
-				now := time.Now()
-				entry.EntryCreated = now
-				if entry.Image != nil {
-					entry.ImageCreated = now
+// schedule periodically clears out old entries and starts refreshes of
+// entries that are due for one. It works on a copy of the entries, so that it
+// doesn't hold up requests while it runs.
+func (c *Cache) schedule() {
+	// Interval for garbage collection and refresh checking
+	scheduleClock := time.NewTicker(scheduleInterval)
+	for range scheduleClock.C {
+		for _, entry := range c.ReadAll() {
+			key := entry.Key()
+			if entry.IsEvictable() && !entry.IsProtected() {
+				fmt.Fprintf(os.Stderr, "Clearing cache entry %s\n", key)
+				c.mu.Lock()
+				// The entry may have been replaced or fetched since it was copied
+				current, exists := c.store.Get(key)
+				if exists && current.IsEvictable() && !current.IsProtected() {
+					c.delete(key, current)
 				}
-				go webhook("image_created", entry)
+				c.mu.Unlock()
+				continue
 			}
-			c.entries[entry.URL.String()] = entry
-
-		case <-scheduleClock.C:
-			size := 0
-			for url, entry := range c.entries {
-				if time.Since(entry.EntryCreated) > cacheTTL {
-					delete(c.entries, url)
-					fmt.Fprintf(os.Stderr, "Clearing cache entry %s\n", url)
-				} else {
-					size += len(entry.Image)
-				}
-				if slices.Contains(autoRefreshHostBlacklist, entry.URL.Host) {
-					continue
-				}
-				if time.Since(entry.LastRefreshAttempt) > autoRefreshAfter {
-					go c.runRefreshTask(entry)
+			if !entry.Expire.IsZero() && time.Now().After(entry.Expire) {
+				c.expire(key, entry)
+				continue
+			}
+			if entry.Pinned || entry.IsAutoRefreshDisabled() || !entry.refreshConf().allowsAt(time.Now()) {
+				continue
+			}
+			if next, ok := entry.NextRefresh(); ok && time.Now().After(next) {
+				priority := PriorityAuto
+				if entry.IsFailedImage() {
+					priority = PriorityRetry
 				}
+				c.queueRefresh(entry, priority)
 			}
-			fmt.Fprintf(os.Stderr,
-				"%s %d images in cache (%s)\n",
-				time.Now().Format("[15:04:05]"),
-				len(c.entries),
-				xlib.FmtByteSize(size, 3),
-			)
 		}
+		c.mu.RLock()
+		count, size := c.store.Len(), c.size
+		c.mu.RUnlock()
+		fmt.Fprintf(os.Stderr,
+			"%s %d images in cache (%s)\n",
+			time.Now().Format("[15:04:05]"),
+			count,
+			xlib.FmtByteSize(size, 3),
+		)
+	}
+}
+
+// expire moves the entry at key through the expired state: It's first marked
+// as expired, which stops it from being refreshed, and its image is freed once
+// it has been expired for expiredGracePeriod.
+func (c *Cache) expire(key string, entry CacheEntry) {
+	switch {
+	case !entry.IsExpired():
+		fmt.Fprintf(os.Stderr, "Cache entry expired: %s\n", key)
+		c.update(key, func(e *CacheEntry) bool {
+			e.ExpiredAt = time.Now()
+			entry = *e
+			return true
+		})
+		sendWebhook("entry_expired", entry)
+	case len(entry.imageHashes()) > 0 && time.Since(entry.ExpiredAt) > expiredGracePeriod:
+		fmt.Fprintf(os.Stderr, "Freeing images of expired cache entry: %s\n", key)
+		c.update(key, func(e *CacheEntry) bool {
+			e.Image, e.ImageHash, e.Versions = nil, "", nil
+			return true
+		})
+	}
+}
+
+// An imageRef tracks how many cache entries refer to a stored image.
+type imageRef struct {
+	refs int
+	size int
+}
+
+// retainImage adds a reference to the image stored at hash. If the image
+// wasn't referenced before, image is stored, or if image is nil, the image is
+// assumed to be stored already. The caller must hold c.mu.
+func (c *Cache) retainImage(hash string, image []byte) {
+	ref, exists := c.images[hash]
+	if !exists {
+		if image == nil {
+			image, _ = c.store.GetImage(hash)
+		} else if err := c.store.PutImage(hash, image); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't store image %s: %s\n", hash, err)
+		}
+		ref.size = len(image)
+		c.size += ref.size
+	}
+	ref.refs++
+	c.images[hash] = ref
+}
+
+// releaseImage removes a reference to the image stored at hash, deleting the
+// image once it's no longer referenced. The caller must hold c.mu.
+func (c *Cache) releaseImage(hash string) {
+	ref := c.images[hash]
+	ref.refs--
+	if ref.refs > 0 {
+		c.images[hash] = ref
+		return
+	}
+	delete(c.images, hash)
+	c.size -= ref.size
+	if err := c.store.DeleteImage(hash); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't delete image %s: %s\n", hash, err)
+	}
+}
+
+// delete removes entry, stored at key, from the cache. The caller must hold
+// c.mu.
+func (c *Cache) delete(key string, entry CacheEntry) {
+	if err := c.store.Delete(key); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't delete cache entry %s: %s\n", key, err)
+	}
+	for _, hash := range entry.imageHashes() {
+		c.releaseImage(hash)
+	}
+}
+
+// enforceBudget evicts entries until the total size of the cached images is
+// within maxCacheSize. The least recently fetched entries are evicted first,
+// and among those, the ones with the lowest score. The entry at keep is never
+// evicted, so a freshly written entry survives even if it's larger than the
+// whole budget. The caller must hold c.mu.
+func (c *Cache) enforceBudget(keep string) {
+	if maxCacheSize <= 0 || c.size <= maxCacheSize {
+		return
+	}
+	type candidate struct {
+		key   string
+		entry CacheEntry
+	}
+	var candidates []candidate
+	c.store.Range(func(key string, entry CacheEntry) bool {
+		if key != keep && len(entry.imageHashes()) > 0 && !entry.IsProtected() {
+			candidates = append(candidates, candidate{key, entry})
+		}
+		return true
+	})
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		if n := a.entry.LastFetched.Compare(b.entry.LastFetched); n != 0 {
+			return n
+		}
+		return a.entry.Score - b.entry.Score
+	})
+	for _, cand := range candidates {
+		if c.size <= maxCacheSize {
+			break
+		}
+		fmt.Fprintf(os.Stderr, "Evicting cache entry %s (%s over budget)\n",
+			cand.key, xlib.FmtByteSize(c.size-maxCacheSize, 3))
+		c.delete(cand.key, cand.entry)
+		c.evictions.Add(1)
 	}
 }
 
-func (c *Cache) scheduleRefresh() {
-	for {
-		<-c.refreshQueue <- struct{}{}
-		time.Sleep(refreshTaskDelay)
+// Flush writes the changes that the store of c hasn't written to its storage
+// yet, if it writes them in the background (see flusher).
+func (c *Cache) Flush() error {
+	if f, ok := c.store.(flusher); ok {
+		return f.Flush()
 	}
+	return nil
+}
+
+// Size returns the total size of the images in the cache, including the ones
+// in version histories. That's the size counted against maxCacheSize.
+func (c *Cache) Size() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.size
+}
+
+// Evictions returns the number of entries evicted to keep the cache within
+// its size budget.
+func (c *Cache) Evictions() int64 {
+	return c.evictions.Load()
 }
 
-// RefreshEntry synchronously queues a background job to capture a fresh
-// screenshot for the cache entry and saves it in the cache. The Decap request
-// uses longer sleep intervals than the one used for synchronous Spectura
-// requests, which typically produces better screenshots.
-func (c *Cache) runRefreshTask(e CacheEntry) {
+// queueRefresh queues a background job with the given priority to capture a
+// fresh screenshot for the cache entry and save it in the cache (see
+// runRefreshTask). If the queue is full and the refresh is dropped,
+// errRefreshQueueFull is returned.
+//
+// If the entry is pinned, or if a refresh of the entry is already running,
+// queueRefresh does nothing. If a refresh of the entry is already queued, its
+// priority is raised if needed.
+//
+// If the entry isn't cached, it's only written to the cache once it has been
+// captured, so that it isn't served without an image in the meantime.
+func (c *Cache) queueRefresh(e CacheEntry, priority RefreshPriority) error {
+	key := e.Key()
+	current := c.Read(key)
+	if current.Pinned {
+		return nil
+	}
+	item := refreshItem{
+		key:      key,
+		host:     refreshHost(e.URL.Hostname()),
+		entry:    e,
+		priority: priority,
+		reason:   priority,
+		queued:   time.Now(),
+		uncached: current.IsEmpty(),
+	}
+	if !c.startRefresh(key) {
+		// Only raises the priority if the refresh is queued, not running
+		c.refreshQueue.raise(item)
+		return nil
+	}
+
+	if !c.refreshQueue.accepts(priority) {
+		c.endRefresh(key)
+		return errRefreshQueueFull
+	}
+
 	e.LastRefreshAttempt = time.Now()
-	cache.WriteMetadata(e)
-	schedule := make(chan struct{})
-	c.refreshQueue <- schedule
-	<-schedule
+	item.entry = e
+	if !item.uncached {
+		cache.WriteMetadata(e)
+	}
+	dropped, ok := c.refreshQueue.push(item)
+	if dropped != nil {
+		fmt.Fprintf(os.Stderr, "Refresh queue is full, dropped %s refresh: %s\n", dropped.priority, dropped.entry.URL)
+		c.endRefresh(dropped.key)
+	}
+	if !ok {
+		c.endRefresh(key)
+		return errRefreshQueueFull
+	}
+	return nil
+}
 
-	fmt.Fprintf(os.Stderr, "Cache refresh (score %d): %s\n", e.Score, e.URL)
-	if err := e.fetchAndCropImage(true, false); err != nil {
-		fmt.Fprintf(os.Stderr, "Giving up on image refresh: %s\n", err)
+// runRefreshTask captures a fresh screenshot for the cache entry of item and
+// saves it in the cache. The Decap request uses longer sleep intervals than
+// the one used for synchronous Spectura requests, which typically produces
+// better screenshots.
+func (c *Cache) runRefreshTask(item refreshItem) {
+	e, key := item.entry, item.key
+	defer c.endRefresh(key)
+
+	// The entry may have been evicted while the refresh was queued
+	if current := c.Read(key); current.IsEmpty() && !item.uncached {
 		return
 	}
-	cache.Write(e)
+	fmt.Fprintf(os.Stderr, "Cache refresh (%s, score %d): %s\n", item.priority, e.Score, e.URL)
+	attempt, shared, err := c.capture(&e, true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Giving up on image refresh: %s\n", err)
+	} else {
+		cache.Write(e)
+	}
+	if !shared {
+		c.recordCapture(key, attempt, err)
+	}
 }
 
 type WebhookBody struct {
@@ -240,6 +641,18 @@ type WebhookBody struct {
 	Expire       int64
 }
 
+// webhooks tracks the webhooks being delivered in the background.
+var webhooks sync.WaitGroup
+
+// sendWebhook delivers a webhook in the background (see webhook).
+func sendWebhook(eventType string, entry CacheEntry) {
+	webhooks.Add(1)
+	go func() {
+		defer webhooks.Done()
+		webhook(eventType, entry)
+	}()
+}
+
 // Sends updates to webook url if it's set
 func webhook(event_type string, entry CacheEntry) {
 	if webhookURL == "" {
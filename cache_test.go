@@ -0,0 +1,561 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestCache returns a Cache backed by a memoryStore, without background
+// jobs.
+func newTestCache() *Cache {
+	c := &Cache{}
+	c.initStore(newMemoryStore())
+	return c
+}
+
+// testEntry returns an entry for rawURL with the given image.
+func testEntry(rawURL string, image string) CacheEntry {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		panic(err)
+	}
+	e := CacheEntry{URL: u, Signature: "s", Expire: time.Now().Add(time.Hour), LastFetched: time.Now()}
+	if image != "" {
+		e.Image = []byte(image)
+		e.ImageHash = imageHash(e.Image)
+		e.Score = 50
+	}
+	return e
+}
+
+// benchmarkCache runs parallel reads of a cache with 1000 entries, with one
+// write for every writeEvery reads, or no writes if writeEvery is 0.
+func benchmarkCache(b *testing.B, writeEvery int) {
+	c := newTestCache()
+	const n = 1000
+	keys := make([]string, n)
+	for i := range keys {
+		e := testEntry(fmt.Sprintf("https://example.com/%d", i), fmt.Sprintf("image %d", i))
+		c.Write(e)
+		keys[i] = e.Key()
+	}
+	var ops atomic.Int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			i := ops.Add(1)
+			if writeEvery > 0 && i%int64(writeEvery) == 0 {
+				c.Write(testEntry(fmt.Sprintf("https://example.com/%d", i%n), fmt.Sprintf("image %d", i)))
+			} else {
+				c.Read(keys[i%n])
+			}
+		}
+	})
+}
+
+func BenchmarkCacheRead(b *testing.B) {
+	benchmarkCache(b, 0)
+}
+
+func BenchmarkCacheReadWrite(b *testing.B) {
+	benchmarkCache(b, 10)
+}
+
+// setGlobal sets *p to v for the duration of the test.
+func setGlobal[T any](t *testing.T, p *T, v T) {
+	old := *p
+	*p = v
+	t.Cleanup(func() { *p = old })
+}
+
+// withImage returns e with the given image and score.
+func withImage(e CacheEntry, image string, score int) CacheEntry {
+	e.Image = []byte(image)
+	e.ImageHash = imageHash(e.Image)
+	e.Score = score
+	return e
+}
+
+func isCached(c *Cache, rawURL string) bool {
+	entry := testEntry(rawURL, "")
+	return c.Read(entry.Key()).ImageHash != ""
+}
+
+func versionHashes(e CacheEntry) []string {
+	var hashes []string
+	for _, v := range e.Versions {
+		hashes = append(hashes, v.ImageHash)
+	}
+	return hashes
+}
+
+func TestMerge(t *testing.T) {
+	setGlobal(t, &imageHistorySize, 2)
+	base := testEntry("https://example.com/ad", "")
+	a, b, c, d := imageHash([]byte("a")), imageHash([]byte("b")), imageHash([]byte("c")), imageHash([]byte("d"))
+
+	tests := []struct {
+		name         string
+		old, new     CacheEntry
+		shared       bool
+		wantHash     string
+		wantVersions []string
+		wantChanges  int
+	}{
+		{
+			name:     "new image",
+			old:      withImage(base, "a", 50),
+			new:      withImage(base, "b", 50),
+			wantHash: b, wantVersions: []string{a}, wantChanges: 1,
+		},
+		{
+			name:     "same hash",
+			old:      withImage(base, "a", 50),
+			new:      withImage(base, "a", 50),
+			wantHash: a,
+		},
+		{
+			name: "pinned",
+			old: func() CacheEntry {
+				e := withImage(base, "a", 50)
+				e.Pinned = true
+				return e
+			}(),
+			new:      withImage(base, "b", 50),
+			wantHash: a,
+		},
+		{
+			name:     "score halved",
+			old:      withImage(base, "a", 30),
+			new:      withImage(base, "b", 14),
+			wantHash: a,
+		},
+		{
+			name:     "score down by more than 20",
+			old:      withImage(base, "a", 80),
+			new:      withImage(base, "b", 59),
+			wantHash: a,
+		},
+		{
+			name:     "small score drop",
+			old:      withImage(base, "a", 80),
+			new:      withImage(base, "b", 60),
+			wantHash: b, wantVersions: []string{a}, wantChanges: 1,
+		},
+		{
+			name: "versions are capped",
+			old: func() CacheEntry {
+				e := withImage(base, "a", 50)
+				e.Versions = []ImageVersion{{ImageHash: b}, {ImageHash: c}}
+				return e
+			}(),
+			new:      withImage(base, "d", 50),
+			wantHash: d, wantVersions: []string{a, b}, wantChanges: 1,
+		},
+		{
+			name: "previous version",
+			old: func() CacheEntry {
+				e := withImage(base, "a", 50)
+				e.Versions = []ImageVersion{{ImageHash: b}}
+				return e
+			}(),
+			new:      withImage(base, "b", 50),
+			wantHash: b, wantVersions: []string{a}, wantChanges: 1,
+		},
+		{
+			name:     "shared capture",
+			old:      withImage(base, "a", 50),
+			new:      withImage(base, "b", 50),
+			shared:   true,
+			wantHash: b, wantVersions: []string{a},
+		},
+		{
+			name:     "metadata only",
+			old:      withImage(base, "a", 50),
+			new:      base,
+			wantHash: a,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			new := tt.new
+			new.captured = !tt.shared
+			got := merge(tt.old, new)
+			if got.ImageHash != tt.wantHash {
+				t.Errorf("ImageHash = %.8s, want %.8s", got.ImageHash, tt.wantHash)
+			}
+			if !slices.Equal(versionHashes(got), tt.wantVersions) {
+				t.Errorf("Versions = %.8s, want %.8s", versionHashes(got), tt.wantVersions)
+			}
+			if got.Changes != tt.wantChanges {
+				t.Errorf("Changes = %d, want %d", got.Changes, tt.wantChanges)
+			}
+		})
+	}
+}
+
+func TestMergeTimestamps(t *testing.T) {
+	old := testEntry("https://example.com/ad", "a")
+	old.LastFetched = time.Now().Add(-time.Hour)
+	old.LastCaptured = time.Now().Add(-time.Hour)
+	new := testEntry("https://example.com/ad", "a")
+	new.captured = true
+
+	got := merge(old, new)
+	if time.Since(got.LastFetched) > time.Minute {
+		t.Errorf("LastFetched = %s, want now", got.LastFetched)
+	}
+	if time.Since(got.LastCaptured) > time.Minute {
+		t.Errorf("LastCaptured = %s, want now", got.LastCaptured)
+	}
+	if got.Captures != 1 {
+		t.Errorf("Captures = %d, want 1", got.Captures)
+	}
+
+	got = merge(old, testEntry("https://example.com/ad", ""))
+	if !got.LastCaptured.Equal(old.LastCaptured) {
+		t.Errorf("LastCaptured = %s after a metadata write, want %s", got.LastCaptured, old.LastCaptured)
+	}
+}
+
+func TestIsEvictable(t *testing.T) {
+	setGlobal(t, &cacheTTL, time.Hour)
+	now := time.Now()
+	entry := func(created, fetched, expire time.Duration) CacheEntry {
+		e := testEntry("https://example.com/ad", "a")
+		e.EntryCreated = now.Add(created)
+		e.LastFetched = now.Add(fetched)
+		e.Expire = time.Time{}
+		if expire != 0 {
+			e.Expire = now.Add(expire)
+		}
+		return e
+	}
+
+	tests := []struct {
+		name   string
+		policy EvictionPolicy
+		entry  CacheEntry
+		want   bool
+	}{
+		{"fixed, new", EvictFixed, entry(-30*time.Minute, 0, 0), false},
+		{"fixed, old", EvictFixed, entry(-2*time.Hour, 0, 0), true},
+		{"sliding, recently fetched", EvictSliding, entry(-2*time.Hour, -30*time.Minute, 0), false},
+		{"sliding, not fetched", EvictSliding, entry(-2*time.Hour, -90*time.Minute, 0), true},
+		{"expire, running", EvictExpire, entry(-2*time.Hour, 0, time.Hour), false},
+		{"expire, expired recently", EvictExpire, entry(-2*time.Hour, 0, -30*time.Minute), false},
+		{"expire, expired long ago", EvictExpire, entry(-3*time.Hour, 0, -2*time.Hour), true},
+		{"expire, no Expire", EvictExpire, entry(-2*time.Hour, 0, 0), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &globalEvictionPolicy, tt.policy)
+			if got := tt.entry.IsEvictable(); got != tt.want {
+				t.Errorf("IsEvictable() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnforceBudget(t *testing.T) {
+	c := newTestCache()
+	now := time.Now()
+	write := func(rawURL, image string, fetched time.Duration, pinned bool) {
+		e := testEntry(rawURL, image)
+		e.LastFetched = now.Add(fetched)
+		e.Pinned = pinned
+		c.Write(e)
+	}
+	// Images are 10 bytes each, and the shared one is only counted once
+	write("https://example.com/pinned", "pinned0000", -4*time.Hour, true)
+	write("https://example.com/oldest", "oldest0000", -3*time.Hour, false)
+	write("https://example.com/shared1", "shared0000", -2*time.Hour, false)
+	write("https://example.com/shared2", "shared0000", -2*time.Hour, false)
+	if c.Size() != 30 {
+		t.Fatalf("Size() = %d, want 30", c.Size())
+	}
+
+	setGlobal(t, &maxCacheSize, 30)
+	write("https://example.com/newest", "newest0000", 0, false)
+	for key, want := range map[string]bool{
+		"https://example.com/pinned":  true,
+		"https://example.com/oldest":  false,
+		"https://example.com/shared1": true,
+		"https://example.com/shared2": true,
+		"https://example.com/newest":  true,
+	} {
+		if got := isCached(c, key); got != want {
+			t.Errorf("%s cached = %t, want %t", key, got, want)
+		}
+	}
+	if c.Size() != 30 || c.Evictions() != 1 {
+		t.Errorf("Size() = %d, Evictions() = %d, want 30 and 1", c.Size(), c.Evictions())
+	}
+
+	// A single entry larger than the budget is kept
+	setGlobal(t, &maxCacheSize, 5)
+	write("https://example.com/newest", "newest1111", 0, false)
+	if !isCached(c, "https://example.com/newest") {
+		t.Error("newest entry was evicted")
+	}
+	if _, ok := c.ReadImage(imageHash([]byte("shared0000"))); ok {
+		t.Error("shared image wasn't deleted")
+	}
+}
+
+func TestMergeExpire(t *testing.T) {
+	now := time.Now()
+	old := testEntry("https://example.com/ad?utm_source=a", "a")
+	old.Expire, old.Signature, old.ExpiredAt = now.Add(-time.Hour), "old", now.Add(-time.Minute)
+	tagged := old
+	tagged.Namespace = "ads"
+
+	tests := []struct {
+		name          string
+		old           CacheEntry
+		url, ns       string
+		expire        time.Time
+		wantSignature string
+		wantNamespace string
+		wantExpired   bool
+	}{
+		{"earlier", old, "https://example.com/ad?utm_source=a", "", now.Add(-2 * time.Hour), "old", "", true},
+		{"later, but passed", old, "https://example.com/ad?utm_source=a", "", now.Add(-time.Minute), "new", "", true},
+		{"later", old, "https://example.com/ad?utm_source=a", "", now.Add(time.Hour), "new", "", false},
+		{"later, other URL variant", old, "https://example.com/ad?utm_source=b", "", now.Add(time.Hour), "old", "", true},
+		{"later, other namespace", tagged, "https://example.com/ad?utm_source=a", "jobs", now.Add(time.Hour), "old", "ads", true},
+		{"untagged, earlier namespace", old, "https://example.com/ad?utm_source=b", "jobs", now.Add(-2 * time.Hour), "new", "jobs", true},
+		{"untagged, later namespace", old, "https://example.com/ad?utm_source=b", "jobs", now.Add(time.Hour), "new", "jobs", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			new := testEntry(tt.url, "")
+			new.Expire, new.Signature, new.Namespace = tt.expire, "new", tt.ns
+			got := merge(tt.old, new)
+			if got.Signature != tt.wantSignature || got.Namespace != tt.wantNamespace || got.IsExpired() != tt.wantExpired {
+				t.Errorf("Signature = %q, Namespace = %q, IsExpired() = %t, want %q, %q and %t",
+					got.Signature, got.Namespace, got.IsExpired(), tt.wantSignature, tt.wantNamespace, tt.wantExpired)
+			}
+		})
+	}
+}
+
+func TestMergeTags(t *testing.T) {
+	old := testEntry("https://example.com/ad", "a")
+	new := testEntry("https://example.com/ad", "")
+	new.Tags, new.Signature = []string{"a", "b"}, "new"
+	got := merge(old, new)
+	if !slices.Equal(got.Tags, new.Tags) || got.Signature != "new" {
+		t.Errorf("Tags = %q, Signature = %q, want %q and %q", got.Tags, got.Signature, new.Tags, "new")
+	}
+
+	new.Tags, new.Signature = []string{"c"}, "other"
+	got = merge(got, new)
+	if !slices.Equal(got.Tags, []string{"a", "b"}) || got.Signature != "new" {
+		t.Errorf("Tags = %q, Signature = %q after retagging, want %q and %q", got.Tags, got.Signature, []string{"a", "b"}, "new")
+	}
+}
+
+func TestRefreshQueue(t *testing.T) {
+	type op struct {
+		key      string
+		priority RefreshPriority
+	}
+	tests := []struct {
+		name        string
+		limit       int
+		pushes      []op
+		raises      []op
+		wantOrder   []string
+		wantDropped []string
+	}{
+		{
+			name:      "priority order",
+			limit:     10,
+			pushes:    []op{{"a", PriorityAuto}, {"b", PriorityBackground}, {"c", PriorityAdmin}, {"d", PriorityBackground}},
+			wantOrder: []string{"c", "b", "d", "a"},
+		},
+		{
+			name:        "full, last item dropped",
+			limit:       2,
+			pushes:      []op{{"a", PriorityAuto}, {"b", PriorityAuto}, {"c", PriorityAdmin}},
+			wantOrder:   []string{"c", "a"},
+			wantDropped: []string{"b"},
+		},
+		{
+			name:        "full, new item dropped",
+			limit:       2,
+			pushes:      []op{{"a", PriorityAdmin}, {"b", PriorityBackground}, {"c", PriorityBackground}},
+			wantOrder:   []string{"a", "b"},
+			wantDropped: []string{"c"},
+		},
+		{
+			name:      "raised",
+			limit:     10,
+			pushes:    []op{{"a", PriorityBackground}, {"b", PriorityAuto}},
+			raises:    []op{{"b", PriorityAdmin}},
+			wantOrder: []string{"b", "a"},
+		},
+		{
+			name:      "not lowered",
+			limit:     10,
+			pushes:    []op{{"a", PriorityAdmin}, {"b", PriorityAdmin}},
+			raises:    []op{{"a", PriorityAuto}},
+			wantOrder: []string{"a", "b"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newRefreshQueue(tt.limit)
+			queued := time.Now()
+			item := func(o op) refreshItem {
+				queued = queued.Add(time.Second)
+				return refreshItem{key: o.key, priority: o.priority, reason: o.priority, queued: queued}
+			}
+			var dropped []string
+			for _, o := range tt.pushes {
+				if d, _ := q.push(item(o)); d != nil {
+					dropped = append(dropped, d.key)
+				}
+			}
+			for _, o := range tt.raises {
+				q.raise(item(o))
+			}
+
+			var order []string
+			var tasks sync.WaitGroup
+			for len(q.items) > 0 {
+				next, _ := q.next(func(refreshItem) bool { return true }, &tasks)
+				order = append(order, next.key)
+				q.done(next)
+				tasks.Done()
+			}
+			if !slices.Equal(order, tt.wantOrder) {
+				t.Errorf("order = %q, want %q", order, tt.wantOrder)
+			}
+			if !slices.Equal(dropped, tt.wantDropped) || q.dropped != int64(len(tt.wantDropped)) {
+				t.Errorf("dropped = %q (counted %d), want %q", dropped, q.dropped, tt.wantDropped)
+			}
+		})
+	}
+}
+
+func TestRefreshQueueAccepts(t *testing.T) {
+	q := newRefreshQueue(1)
+	q.push(refreshItem{key: "a", priority: PriorityBackground})
+	for _, tt := range []struct {
+		priority RefreshPriority
+		want     bool
+	}{
+		{PriorityAuto, false},
+		{PriorityBackground, false},
+		{PriorityRetry, true},
+		{PriorityAdmin, true},
+	} {
+		if got := q.accepts(tt.priority); got != tt.want {
+			t.Errorf("accepts(%s) = %t, want %t", tt.priority, got, tt.want)
+		}
+	}
+	if q.dropped != 2 {
+		t.Errorf("dropped = %d, want 2", q.dropped)
+	}
+}
+
+func TestRefreshWindow(t *testing.T) {
+	tests := []struct {
+		window, at string
+		want       bool
+	}{
+		{"09:00-17:00", "08:59", false},
+		{"09:00-17:00", "09:00", true},
+		{"09:00-17:00", "16:59", true},
+		{"09:00-17:00", "17:00", false},
+		{"20:00-06:00", "19:59", false},
+		{"20:00-06:00", "20:00", true},
+		{"20:00-06:00", "23:59", true},
+		{"20:00-06:00", "00:00", true},
+		{"20:00-06:00", "05:59", true},
+		{"20:00-06:00", "06:00", false},
+		{"20:00-06:00", "12:00", false},
+	}
+	for _, tt := range tests {
+		var w refreshWindow
+		if err := json.Unmarshal([]byte(strconv.Quote(tt.window)), &w); err != nil {
+			t.Fatal(err)
+		}
+		at, err := time.Parse("15:04", tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := w.contains(at); got != tt.want {
+			t.Errorf("%s contains %s = %t, want %t", tt.window, tt.at, got, tt.want)
+		}
+		if w.String() != tt.window {
+			t.Errorf("String() = %s, want %s", w, tt.window)
+		}
+	}
+
+	for _, bad := range []string{"20:00", "20:00-20:00", "25:00-06:00", "8-17"} {
+		var w refreshWindow
+		if err := json.Unmarshal([]byte(strconv.Quote(bad)), &w); err == nil {
+			t.Errorf("refresh window %q was accepted", bad)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	tests := []struct {
+		name        string
+		rate, size  float64
+		spent       int
+		elapsed     time.Duration
+		takes, want int
+	}{
+		{"burst", 60, 3, 0, 0, 5, 3},
+		{"empty", 60, 3, 3, 0, 2, 0},
+		{"refilled", 60, 3, 3, 2 * time.Second, 5, 2},
+		{"refill capped at size", 60, 3, 3, time.Hour, 5, 3},
+		{"size at least 1", 60, 0.5, 0, 0, 2, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTokenBucket(tt.rate, tt.size)
+			for range tt.spent {
+				b.take()
+			}
+			b.denied = 0
+			b.last = b.last.Add(-tt.elapsed)
+			taken := 0
+			for range tt.takes {
+				if b.take() {
+					taken++
+				}
+			}
+			if taken != tt.want || b.denied != int64(tt.takes-tt.want) {
+				t.Errorf("took %d of %d (%d denied), want %d", taken, tt.takes, b.denied, tt.want)
+			}
+		})
+	}
+
+	var unlimited *tokenBucket
+	if !unlimited.take() {
+		t.Error("nil bucket denied a token")
+	}
+}
+
+func TestNewDecapBudget(t *testing.T) {
+	interactive, background := newDecapBudget(100, 10, 20)
+	if interactive.rate != 80 || interactive.size != 8 || background.rate != 20 || background.size != 2 {
+		t.Errorf("interactive = %s, background = %s, want 80/min of 8 and 20/min of 2", interactive, background)
+	}
+	if interactive, background = newDecapBudget(0, 10, 20); interactive != nil || background != nil {
+		t.Error("zero rate isn't unlimited")
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// canonicalConf controls how URLs are canonicalized into cache keys, so that
+// variants of the same page (e.g. with different tracking parameters) share a
+// single cache entry. It is configured globally through the environment and
+// per host through the "canonical" field in image_conf.json, where unset
+// options fall back to the global configuration.
+type canonicalConf struct {
+	SortQuery     *bool    `json:"sort_query"`
+	StripFragment *bool    `json:"strip_fragment"`
+	LowercaseHost *bool    `json:"lowercase_host"`
+	DropParams    []string `json:"drop_params"`
+}
+
+var globalCanonicalConf canonicalConf
+
+// parseCanonicalOptions sets up globalCanonicalConf from a comma-separated
+// list of enabled options and a comma-separated list of query parameters to
+// drop.
+func parseCanonicalOptions(options, dropParams string) error {
+	enabled := func(b bool) *bool { return &b }
+	conf := canonicalConf{
+		SortQuery:     enabled(false),
+		StripFragment: enabled(false),
+		LowercaseHost: enabled(false),
+	}
+	for _, opt := range strings.Split(options, ",") {
+		switch strings.TrimSpace(opt) {
+		case "":
+		case "sort_query":
+			conf.SortQuery = enabled(true)
+		case "strip_fragment":
+			conf.StripFragment = enabled(true)
+		case "lowercase_host":
+			conf.LowercaseHost = enabled(true)
+		default:
+			return fmt.Errorf("unknown option %q", opt)
+		}
+	}
+	for _, param := range strings.Split(dropParams, ",") {
+		if param = strings.TrimSpace(param); param != "" {
+			conf.DropParams = append(conf.DropParams, param)
+		}
+	}
+	globalCanonicalConf = conf
+	return nil
+}
+
+// with returns the configuration for a host, which overrides c with any
+// options set in hostConf. Dropped parameters are added to those of c.
+func (c canonicalConf) with(hostConf *canonicalConf) canonicalConf {
+	if hostConf == nil {
+		return c
+	}
+	if hostConf.SortQuery != nil {
+		c.SortQuery = hostConf.SortQuery
+	}
+	if hostConf.StripFragment != nil {
+		c.StripFragment = hostConf.StripFragment
+	}
+	if hostConf.LowercaseHost != nil {
+		c.LowercaseHost = hostConf.LowercaseHost
+	}
+	c.DropParams = append(slices.Clip(c.DropParams), hostConf.DropParams...)
+	return c
+}
+
+// cacheKey returns the key used for u in the cache, which is a canonical form
+// of u according to the global and per-host canonicalization options.
+func cacheKey(u *url.URL) string {
+	conf := globalCanonicalConf.with(
+		getConfFromHostname(strings.ToLower(u.Hostname())).Canonical,
+	)
+	k := *u
+	if isSet(conf.LowercaseHost) {
+		k.Host = strings.ToLower(k.Host)
+	}
+	if isSet(conf.StripFragment) {
+		k.Fragment, k.RawFragment = "", ""
+	}
+
+	// The raw query is filtered and sorted instead of being decoded and
+	// re-encoded, so that the key only differs from the URL where needed.
+	var params []string
+	for _, param := range strings.Split(k.RawQuery, "&") {
+		if param == "" {
+			continue
+		}
+		if slices.Contains(conf.DropParams, queryParamName(param)) {
+			continue
+		}
+		params = append(params, param)
+	}
+	if isSet(conf.SortQuery) {
+		slices.SortStableFunc(params, func(a, b string) int {
+			return strings.Compare(queryParamName(a), queryParamName(b))
+		})
+	}
+	k.RawQuery = strings.Join(params, "&")
+	k.ForceQuery = false
+	return k.String()
+}
+
+// Key returns the key of e in the cache.
+func (e *CacheEntry) Key() string {
+	return cacheKey(e.URL)
+}
+
+func queryParamName(param string) string {
+	name, _, _ := strings.Cut(param, "=")
+	if unescaped, err := url.QueryUnescape(name); err == nil {
+		return unescaped
+	}
+	return name
+}
+
+func isSet(b *bool) bool {
+	return b != nil && *b
+}
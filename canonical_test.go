@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"testing"
+)
+
+func TestCacheKey(t *testing.T) {
+	setGlobal(t, &globalImageConf, map[string]imageConfEntry{
+		"example.org": {Canonical: &canonicalConf{
+			SortQuery:  new(bool),
+			DropParams: []string{"ref"},
+		}},
+	})
+
+	tests := []struct {
+		name       string
+		options    string
+		dropParams string
+		url        string
+		want       string
+	}{
+		{"no options", "", "", "https://Example.com/ad?b=1&a=2#top", "https://Example.com/ad?b=1&a=2#top"},
+		{"lowercase host", "lowercase_host", "", "https://Example.com/Ad", "https://example.com/Ad"},
+		{"sort query", "sort_query", "", "https://example.com/ad?b=1&a=2&b=0", "https://example.com/ad?a=2&b=1&b=0"},
+		{"strip fragment", "strip_fragment", "", "https://example.com/ad?a=1#top", "https://example.com/ad?a=1"},
+		{"drop params", "", "utm_source,fbclid", "https://example.com/ad?utm_source=x&a=1&fbclid=y", "https://example.com/ad?a=1"},
+		{"drop escaped param", "", "utm_source", "https://example.com/ad?utm%5Fsource=x&a=1", "https://example.com/ad?a=1"},
+		{"drop all params", "", "utm_source", "https://example.com/ad?utm_source=x", "https://example.com/ad"},
+		{"query kept as is", "sort_query", "", "https://example.com/ad?q=a+b%2Fc", "https://example.com/ad?q=a+b%2Fc"},
+		{"host overrides", "sort_query", "utm_source", "https://www.example.org/ad?b=1&ref=x&utm_source=y&a=2", "https://www.example.org/ad?b=1&a=2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setGlobal(t, &globalCanonicalConf, canonicalConf{})
+			if err := parseCanonicalOptions(tt.options, tt.dropParams); err != nil {
+				t.Fatal(err)
+			}
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cacheKey(u); got != tt.want {
+				t.Errorf("cacheKey(%s) = %s, want %s", tt.url, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCanonicalOptions(t *testing.T) {
+	setGlobal(t, &globalCanonicalConf, canonicalConf{})
+	if err := parseCanonicalOptions("sort_query,bogus", ""); err == nil {
+		t.Error("unknown option was accepted")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// An EvictionPolicy decides when a cache entry is old enough to be deleted.
+// It is configured globally through EVICTION_POLICY and per host through the
+// "eviction" field in image_conf.json.
+type EvictionPolicy string
+
+const (
+	// EvictFixed deletes entries cacheTTL after they were created.
+	EvictFixed EvictionPolicy = "fixed"
+	// EvictSliding deletes entries cacheTTL after they were last fetched, so
+	// that entries are kept for as long as they are in use.
+	EvictSliding EvictionPolicy = "sliding"
+	// EvictExpire deletes entries cacheTTL after their Expire time, so that
+	// entries are kept for as long as the ad they belong to runs.
+	EvictExpire EvictionPolicy = "expire"
+)
+
+var globalEvictionPolicy = EvictFixed
+
+func parseEvictionPolicy(s string) (EvictionPolicy, error) {
+	switch p := EvictionPolicy(strings.TrimSpace(s)); p {
+	case EvictFixed, EvictSliding, EvictExpire:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown eviction policy %q", s)
+	}
+}
+
+// UnmarshalJSON makes sure that policies in image_conf.json are valid.
+func (p *EvictionPolicy) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	policy, err := parseEvictionPolicy(s)
+	if err != nil {
+		return err
+	}
+	*p = policy
+	return nil
+}
+
+// deadline returns the time at which p deletes e. Entries that have never
+// been fetched, or have no Expire time, are treated as under EvictFixed.
+func (p EvictionPolicy) deadline(e *CacheEntry) time.Time {
+	start := e.EntryCreated
+	switch {
+	case p == EvictSliding && e.LastFetched.After(start):
+		start = e.LastFetched
+	case p == EvictExpire && !e.Expire.IsZero():
+		start = e.Expire
+	}
+	return start.Add(cacheTTL)
+}
+
+// EvictionPolicy returns the eviction policy configured for the host of e.
+func (e *CacheEntry) EvictionPolicy() EvictionPolicy {
+	if policy := getConfFromHostname(strings.ToLower(e.URL.Hostname())).Eviction; policy != "" {
+		return policy
+	}
+	return globalEvictionPolicy
+}
+
+// EvictAt returns the time at which e is deleted from the cache.
+func (e *CacheEntry) EvictAt() time.Time {
+	return e.EvictionPolicy().deadline(e)
+}
+
+// IsEvictable reports whether e is due to be deleted from the cache.
+func (e *CacheEntry) IsEvictable() bool {
+	return time.Now().After(e.EvictAt())
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A fileStore is a CacheStore that persists its entries in a directory, so
+// the contents of a Cache survive restarts. Each entry is stored as a JSON
+// metadata file in the "entries" subdirectory, named after a hash of the cache
+// key. Images are stored as PNG files in the "images" subdirectory, named
+// after their content hash.
+//
+// All entries and images are also kept in memory, so only writes touch the
+// disk. Like in an s3Store, changes are written in the background, so that the
+// Cache isn't held up by the disk.
+type fileStore struct {
+	dir string
+	mem *memoryStore
+
+	dirtyMu      sync.Mutex
+	dirtyEntries map[string]bool
+	dirtyImages  map[string]bool
+	// flushMu serializes flushes, so that older versions of an entry are
+	// never written after newer ones
+	flushMu sync.Mutex
+	// flushes is signalled when changes are marked as dirty
+	flushes chan struct{}
+}
+
+// An entryRecord is the serializable form of a CacheEntry, minus the image.
+type entryRecord struct {
+	Expire             time.Time
+	Signature          string
+	URL                string
+	EntryCreated       time.Time
+	ImageCreated       time.Time
+	LastCaptured       time.Time
+	LastRefreshAttempt time.Time
+	LastFetched        time.Time
+	Provenance         Provenance
+	Score              int
+	ImageHash          string
+	Crop               CropParams
+	Versions           []ImageVersion
+	ExpiredAt          time.Time
+	FailedAttempts     int
+	LastError          string
+	Pinned             bool
+	Namespace          string
+	Tags               []string
+	Captures           int
+	Changes            int
+	RefreshInterval    time.Duration
+	Attempts           []CaptureAttempt
+}
+
+func newEntryRecord(e CacheEntry) entryRecord {
+	return entryRecord{
+		Expire:             e.Expire,
+		Signature:          e.Signature,
+		URL:                e.URL.String(),
+		EntryCreated:       e.EntryCreated,
+		ImageCreated:       e.ImageCreated,
+		LastCaptured:       e.LastCaptured,
+		LastRefreshAttempt: e.LastRefreshAttempt,
+		LastFetched:        e.LastFetched,
+		Provenance:         e.Provenance,
+		Score:              e.Score,
+		ImageHash:          e.ImageHash,
+		Crop:               e.Crop,
+		Versions:           e.Versions,
+		ExpiredAt:          e.ExpiredAt,
+		FailedAttempts:     e.FailedAttempts,
+		LastError:          e.LastError,
+		Pinned:             e.Pinned,
+		Namespace:          e.Namespace,
+		Tags:               e.Tags,
+		Captures:           e.Captures,
+		Changes:            e.Changes,
+		RefreshInterval:    e.RefreshInterval,
+		Attempts:           e.Attempts,
+	}
+}
+
+func (r entryRecord) entry() (CacheEntry, error) {
+	u, err := url.Parse(r.URL)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	return CacheEntry{
+		Expire:             r.Expire,
+		Signature:          r.Signature,
+		URL:                u,
+		EntryCreated:       r.EntryCreated,
+		ImageCreated:       r.ImageCreated,
+		LastCaptured:       r.LastCaptured,
+		LastRefreshAttempt: r.LastRefreshAttempt,
+		LastFetched:        r.LastFetched,
+		Provenance:         r.Provenance,
+		Score:              r.Score,
+		ImageHash:          r.ImageHash,
+		Crop:               r.Crop,
+		Versions:           r.Versions,
+		ExpiredAt:          r.ExpiredAt,
+		FailedAttempts:     r.FailedAttempts,
+		LastError:          r.LastError,
+		Pinned:             r.Pinned,
+		Namespace:          r.Namespace,
+		Tags:               r.Tags,
+		Captures:           r.Captures,
+		Changes:            r.Changes,
+		RefreshInterval:    r.RefreshInterval,
+		Attempts:           r.Attempts,
+	}, nil
+}
+
+// openFileStore opens the file store in dir, creating the directory if it
+// doesn't exist, and loads the entries saved in it by a previous run.
+func openFileStore(dir string) (*fileStore, error) {
+	s := &fileStore{
+		dir:          dir,
+		mem:          newMemoryStore(),
+		dirtyEntries: make(map[string]bool),
+		dirtyImages:  make(map[string]bool),
+		flushes:      make(chan struct{}, 1),
+	}
+	for _, sub := range []string{"entries", "images"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "Loaded %d cache entries from %s\n", s.mem.Len(), dir)
+	go s.flushChanges()
+	return s, nil
+}
+
+func diskName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func (s *fileStore) entryPath(key string) string {
+	return filepath.Join(s.dir, "entries", diskName(key)+".json")
+}
+
+func (s *fileStore) imagePath(hash string) string {
+	return filepath.Join(s.dir, "images", hash+".png")
+}
+
+func (s *fileStore) Get(key string) (CacheEntry, bool) {
+	return s.mem.Get(key)
+}
+
+func (s *fileStore) Put(key string, entry CacheEntry) error {
+	s.mem.Put(key, entry)
+	s.markDirty(s.dirtyEntries, key)
+	return nil
+}
+
+func (s *fileStore) Delete(key string) error {
+	s.mem.Delete(key)
+	s.markDirty(s.dirtyEntries, key)
+	return nil
+}
+
+func (s *fileStore) Range(fn func(key string, entry CacheEntry) bool) {
+	s.mem.Range(fn)
+}
+
+func (s *fileStore) Len() int {
+	return s.mem.Len()
+}
+
+func (s *fileStore) GetImage(hash string) ([]byte, bool) {
+	return s.mem.GetImage(hash)
+}
+
+// PutImage stores image and queues it to be written to disk, unless an image
+// with the same hash is already stored.
+func (s *fileStore) PutImage(hash string, image []byte) error {
+	if _, exists := s.mem.GetImage(hash); exists {
+		return nil
+	}
+	s.mem.PutImage(hash, image)
+	s.markDirty(s.dirtyImages, hash)
+	return nil
+}
+
+func (s *fileStore) DeleteImage(hash string) error {
+	s.mem.DeleteImage(hash)
+	s.markDirty(s.dirtyImages, hash)
+	return nil
+}
+
+// markDirty adds id to dirty, so that the change is written to disk by
+// flushChanges.
+func (s *fileStore) markDirty(dirty map[string]bool, id string) {
+	s.dirtyMu.Lock()
+	dirty[id] = true
+	s.dirtyMu.Unlock()
+	select {
+	case s.flushes <- struct{}{}:
+	default:
+	}
+}
+
+// flushChanges writes the changes marked as dirty to disk.
+func (s *fileStore) flushChanges() {
+	for range s.flushes {
+		if err := s.Flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write cache changes to %s: %s\n", s.dir, err)
+		}
+	}
+}
+
+// Flush writes the changes recorded in the dirty sets to disk, writing or
+// removing each entry and image according to whether it's still stored.
+// Images are written first, so that entries never refer to images that aren't
+// on disk. Changes that fail are dropped, and the errors are returned.
+func (s *fileStore) Flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.dirtyMu.Lock()
+	images, entries := maps.Clone(s.dirtyImages), maps.Clone(s.dirtyEntries)
+	clear(s.dirtyImages)
+	clear(s.dirtyEntries)
+	s.dirtyMu.Unlock()
+
+	var errs []error
+	for hash := range images {
+		var err error
+		if image, exists := s.mem.GetImage(hash); exists {
+			err = writeFileAtomic(s.imagePath(hash), image)
+		} else {
+			err = removeFile(s.imagePath(hash))
+		}
+		errs = append(errs, err)
+	}
+	for key := range entries {
+		var err error
+		if entry, exists := s.mem.Get(key); exists {
+			var content []byte
+			if content, err = json.Marshal(newEntryRecord(entry)); err == nil {
+				err = writeFileAtomic(s.entryPath(key), content)
+			}
+		} else {
+			err = removeFile(s.entryPath(key))
+		}
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+// load reads every entry stored on disk along with the images they refer to.
+// Entries that are due to be evicted are deleted instead of being loaded, so
+// that stale entries aren't revived, and images that no entry refers to are
+// deleted as well.
+func (s *fileStore) load() error {
+	files, err := os.ReadDir(filepath.Join(s.dir, "entries"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		path := filepath.Join(s.dir, "entries", file.Name())
+		content, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't read cache entry %s: %s\n", path, err)
+			continue
+		}
+		var record entryRecord
+		if err = json.Unmarshal(content, &record); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't decode cache entry %s: %s\n", path, err)
+			continue
+		}
+		entry, err := record.entry()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Bad URL in cache entry %s: %s\n", path, err)
+			continue
+		}
+		key := entry.Key()
+		if entry.IsEvictable() && !entry.IsProtected() {
+			if err = removeFile(path); err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't remove stale cache entry %s: %s\n", key, err)
+			}
+			continue
+		}
+		if entry.ImageHash != "" {
+			if _, err = os.Stat(s.imagePath(entry.ImageHash)); err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't find cached image for %s: %s\n", key, err)
+				entry.ImageHash = ""
+			}
+		}
+		entry.Versions = slices.DeleteFunc(entry.Versions, func(v ImageVersion) bool {
+			_, err := os.Stat(s.imagePath(v.ImageHash))
+			return err != nil
+		})
+		// The key changes if the canonicalization options have changed
+		if s.entryPath(key) != path {
+			if err = os.Rename(path, s.entryPath(key)); err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't rename cache entry %s: %s\n", path, err)
+			}
+		}
+		s.mem.Put(key, entry)
+	}
+
+	referenced := make(map[string]bool)
+	s.mem.Range(func(_ string, entry CacheEntry) bool {
+		for _, hash := range entry.imageHashes() {
+			referenced[hash] = true
+		}
+		return true
+	})
+	files, err = os.ReadDir(filepath.Join(s.dir, "images"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		hash, ok := strings.CutSuffix(file.Name(), ".png")
+		if file.IsDir() || !ok {
+			continue
+		}
+		path := s.imagePath(hash)
+		if !referenced[hash] {
+			if err = removeFile(path); err != nil {
+				fmt.Fprintf(os.Stderr, "Couldn't remove unused image %s: %s\n", path, err)
+			}
+			continue
+		}
+		image, err := os.ReadFile(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't read cached image %s: %s\n", path, err)
+			continue
+		}
+		s.mem.PutImage(hash, image)
+	}
+	return nil
+}
+
+// removeFile removes the file at path. A file that doesn't exist isn't
+// considered an error.
+func removeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place, so that a crash never leaves a half-written file behind.
+func writeFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	if _, err = f.Write(data); err == nil {
+		err = f.Close()
+	} else {
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
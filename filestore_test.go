@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileStoreFlush(t *testing.T) {
+	setGlobal(t, &cacheTTL, time.Hour)
+	dir := t.TempDir()
+	store, err := openFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Cache{}
+	c.initStore(store)
+	kept := testEntry("https://example.com/kept", "kept")
+	deleted := testEntry("https://example.com/deleted", "deleted")
+	c.Write(kept)
+	c.Write(deleted)
+	stored := c.Read(deleted.Key())
+	c.mu.Lock()
+	c.delete(deleted.Key(), stored)
+	c.mu.Unlock()
+	if err = c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := reopened.Get(kept.Key()); !ok || got.ImageHash != kept.ImageHash {
+		t.Errorf("reopened entry = %.8s (found %t), want %.8s", got.ImageHash, ok, kept.ImageHash)
+	}
+	if _, ok := reopened.GetImage(kept.ImageHash); !ok {
+		t.Error("image of reopened entry is missing")
+	}
+	if _, ok := reopened.Get(deleted.Key()); ok {
+		t.Error("deleted entry was reopened")
+	}
+}
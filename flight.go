@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A flightGroup coalesces concurrent calls with the same key, so that only one
+// of them does the work while the others wait for it and share its result.
+// The zero value is ready to use.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	done  chan struct{}
+	entry CacheEntry
+	err   error
+}
+
+// Do calls fn and returns its result, unless a call with the same key is
+// already in flight, in which case Do waits for that call and returns its
+// result instead. shared reports whether the result came from another call.
+func (g *flightGroup) Do(key string, fn func() (CacheEntry, error)) (entry CacheEntry, shared bool, err error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.entry, true, call.err
+	}
+	call := &flightCall{done: make(chan struct{})}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.entry, call.err = fn()
+	return call.entry, false, call.err
+}
+
+// capture takes a screenshot of e.URL and stores it in e (see
+// fetchAndCropImage). If a capture of the same URL is already in flight, be it
+// for a cache miss or a background refresh, capture waits for it and uses its
+// result instead of sending another request to Decap. shared reports whether
+// that was the case. Otherwise, attempt describes the capture, to be recorded
+// with recordCapture, and e counts as captured when it's written (see merge).
+//
+// Captures draw from the Decap budget, unless they join one in flight.
+// Background captures wait for it, while other captures fail with
+// errDecapBudget if the interactive budget is exhausted, rather than keeping a
+// request waiting.
+func (c *Cache) capture(e *CacheEntry, background bool) (attempt CaptureAttempt, shared bool, err error) {
+	var res CacheEntry
+	res, shared, err = c.captures.Do(e.Key(), func() (CacheEntry, error) {
+		if background {
+			backgroundBudget.wait()
+		} else if !interactiveBudget.take() {
+			return CacheEntry{}, errDecapBudget
+		}
+		attempt = CaptureAttempt{Time: time.Now(), Mode: "fast"}
+		if background {
+			attempt.Mode = "slow"
+		}
+		res := CacheEntry{URL: e.URL}
+		status, err := res.fetchAndCropImage(background, false)
+		attempt.DecapStatus, attempt.Error = status, errorClass(err)
+		attempt.Duration = time.Since(attempt.Time)
+		return res, err
+	})
+	if shared {
+		fmt.Fprintf(os.Stderr, "Joined in-flight capture: %s\n", e.URL)
+	}
+	if err == nil {
+		e.Image, e.ImageHash, e.Score, e.Crop = res.Image, res.ImageHash, res.Score, res.Crop
+	}
+	e.captured = err == nil && !shared
+	return attempt, shared, err
+}
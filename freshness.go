@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+)
+
+// Freshness describes how up to date the image of a CacheEntry is. It's
+// derived from the time since the image was last captured (see
+// CapturedAt), using freshWindow and staleWindow.
+type Freshness string
+
+const (
+	// Fresh images are younger than freshWindow and served as is.
+	Fresh Freshness = "fresh"
+	// Stale images are older than freshWindow, but still within staleWindow
+	// after that. They are served immediately, while a refresh is started.
+	Stale Freshness = "stale"
+	// Revalidating images are being refreshed.
+	Revalidating Freshness = "revalidating"
+	// Outdated images are too old to be served without trying to capture a
+	// new image first. They are only served if that capture fails.
+	Outdated Freshness = "outdated"
+	// Missing means that there is no image.
+	Missing Freshness = "missing"
+	// Pinned images are served regardless of their age.
+	Pinned Freshness = "pinned"
+)
+
+// freshnessHeader is the response header telling clients the Freshness of
+// the served screenshot.
+const freshnessHeader = "X-Spectura-Freshness"
+
+// CapturedAt returns when the image of e was last confirmed by a capture. An
+// image that's captured again unchanged keeps its ImageCreated, but is as up
+// to date as a new one. Entries stored before LastCaptured was recorded fall
+// back to ImageCreated.
+func (e *CacheEntry) CapturedAt() time.Time {
+	if e.LastCaptured.After(e.ImageCreated) {
+		return e.LastCaptured
+	}
+	return e.ImageCreated
+}
+
+// Freshness returns the freshness state of e.
+func (e *CacheEntry) Freshness() Freshness {
+	age := time.Since(e.CapturedAt())
+	switch {
+	case e.ImageHash == "":
+		return Missing
+	case e.Pinned:
+		return Pinned
+	case cache.IsRefreshing(e.Key()):
+		return Revalidating
+	case age < freshWindow:
+		return Fresh
+	case age < freshWindow+staleWindow:
+		return Stale
+	default:
+		return Outdated
+	}
+}
+
+// startRefresh marks the entry at key as being refreshed. It reports false if
+// a refresh of the entry is already in progress.
+func (c *Cache) startRefresh(key string) bool {
+	c.refreshingMu.Lock()
+	defer c.refreshingMu.Unlock()
+	if c.refreshing[key] {
+		return false
+	}
+	c.refreshing[key] = true
+	return true
+}
+
+// endRefresh marks the refresh of the entry at key as done.
+func (c *Cache) endRefresh(key string) {
+	c.refreshingMu.Lock()
+	defer c.refreshingMu.Unlock()
+	delete(c.refreshing, key)
+}
+
+// IsRefreshing reports whether a refresh of the entry at key is queued or in
+// progress.
+func (c *Cache) IsRefreshing(key string) bool {
+	c.refreshingMu.Lock()
+	defer c.refreshingMu.Unlock()
+	return c.refreshing[key]
+}
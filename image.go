@@ -47,11 +47,15 @@ type SubImager interface {
 	SubImage(r image.Rectangle) image.Image
 }
 
-func (entry *CacheEntry) fetchAndCropImage(background, nocrop bool) error {
+// fetchAndCropImage captures a screenshot of entry.URL with Decap, crops it
+// unless nocrop is set, and stores it in entry. Background captures use the
+// slow mode of imageFromDecap. decapStatus is the status of the Decap
+// response, or 0 if Decap couldn't be reached.
+func (entry *CacheEntry) fetchAndCropImage(background, nocrop bool) (decapStatus int, err error) {
 	var im image.Image
-	err := imageFromDecap(&im, entry.URL, !background)
+	decapStatus, err = imageFromDecap(&im, entry.URL, !background)
 	if err != nil {
-		return err
+		return decapStatus, err
 	}
 
 	var m *image.NRGBA
@@ -63,30 +67,31 @@ func (entry *CacheEntry) fetchAndCropImage(background, nocrop bool) error {
 		m = image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
 		draw.Draw(m, m.Bounds(), im, b.Min, draw.Src)
 	default:
-		return fmt.Errorf("Unexpected image type %T", im)
+		return decapStatus, fmt.Errorf("Unexpected image type %T", im)
 	}
 
 	if !nocrop {
-		m = cropImage(m, entry.URL)
+		m, entry.Crop = cropImage(m, entry.URL)
 		if m.Bounds().Dy() < OGImageHeight {
-			return croppingError
+			return decapStatus, croppingError
 		}
 	}
 	var buf bytes.Buffer
 	if err = png.Encode(&buf, m); err != nil {
-		return fmt.Errorf("failed to encode the generated PNG: %w", err)
+		return decapStatus, fmt.Errorf("failed to encode the generated PNG: %w", err)
 	}
 	entry.Image = buf.Bytes()
+	entry.ImageHash = imageHash(entry.Image)
 	entry.Score = calculateScore(m)
 
 	if len(entry.Image) > maxImageSize {
 		fmt.Fprintf(os.Stderr, "Warning: Size of generated image (%s) exceeds %s\n",
 			xlib.FmtByteSize(len(entry.Image), 3), xlib.FmtByteSize(maxImageSize, 3))
 	}
-	return nil
+	return decapStatus, nil
 }
 
-func cropImage(m *image.NRGBA, targetURL *url.URL) *image.NRGBA {
+func cropImage(m *image.NRGBA, targetURL *url.URL) (*image.NRGBA, CropParams) {
 	voffset := getConfFromHostname(targetURL.Hostname()).Voffset * scalingFactor
 
 	// If the image contains more than 25 background-looking rows, we remove
@@ -136,7 +141,7 @@ func cropImage(m *image.NRGBA, targetURL *url.URL) *image.NRGBA {
 
 	cropRect = image.Rect(0, voffset, OGImageWidth, voffset+OGImageHeight)
 	cropRect.Add(m.Bounds().Min)
-	return m.SubImage(cropRect).(*image.NRGBA)
+	return m.SubImage(cropRect).(*image.NRGBA), CropParams{voffset, topMargin}
 }
 
 func countSingleColoredRows(m *image.NRGBA, offset int) (int, color.NRGBA) {
@@ -211,7 +216,7 @@ func calculateScore(m *image.NRGBA) int {
 	return int(math.Ceil((maxArea - float64(largestArea)) * 100 / maxArea))
 }
 
-func imageFromDecap(m *image.Image, targetURL *url.URL, fast bool) error {
+func imageFromDecap(m *image.Image, targetURL *url.URL, fast bool) (status int, err error) {
 	var d0, d1, timeout time.Duration
 	if fast {
 		d0 = fastInitDelay
@@ -253,29 +258,29 @@ func imageFromDecap(m *image.Image, targetURL *url.URL, fast bool) error {
 	}
 
 	var buf bytes.Buffer
-	err := json.NewEncoder(&buf).Encode(req)
+	err = json.NewEncoder(&buf).Encode(req)
 	if err != nil {
-		return fmt.Errorf("couldn't encode JSON response body: %w", err)
+		return 0, fmt.Errorf("couldn't encode JSON response body: %w", err)
 	}
 
 	var res *http.Response
 	res, err = http.Post(fmt.Sprintf("%s/api/decap/v0/browse", decapURL), "application/json", &buf)
 	if err != nil {
-		return fmt.Errorf("couldn't connect to Decap: %w", err)
+		return 0, fmt.Errorf("couldn't connect to Decap: %w", err)
 	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 || res.Header.Get("Content-Type") != "image/png" {
 		msg, _ := io.ReadAll(res.Body)
 		if res.StatusCode == 500 {
-			return fmt.Errorf("%w: %s; %s", decapInternalError, res.Status, msg)
+			return res.StatusCode, fmt.Errorf("%w: %s; %s", decapInternalError, res.Status, msg)
 		}
-		return fmt.Errorf("%w: %s; %s", decapRequestError, res.Status, msg)
+		return res.StatusCode, fmt.Errorf("%w: %s; %s", decapRequestError, res.Status, msg)
 	}
 
 	if *m, err = png.Decode(res.Body); err != nil {
-		return fmt.Errorf("couldn't decode PNG from Decap: %w", err)
+		return res.StatusCode, fmt.Errorf("couldn't decode PNG from Decap: %w", err)
 	}
-	return nil
+	return res.StatusCode, nil
 }
 
 func decapAction(list ...string) decap.Action {
@@ -316,10 +321,9 @@ func (c *Cache) initFallbackImage() {
 			}
 			fmt.Fprintf(os.Stderr, "Replacing fallback image with %s\n", fallbackImageURL)
 
-			// lock cache while fallback image is replaced
-			c.readQuery <- ""
+			c.mu.Lock()
 			c.fallbackImage = buf.Bytes()
-			<-c.readReply
+			c.mu.Unlock()
 
 			return
 		}
@@ -338,14 +342,17 @@ func encodeEmptyPNG(width, height int) []byte {
 }
 
 type imageConfEntry struct {
-	Delay   int `json:"delay"`
-	Voffset int `json:"voffset"`
+	Delay     int            `json:"delay"`
+	Voffset   int            `json:"voffset"`
+	Canonical *canonicalConf `json:"canonical"`
+	Eviction  EvictionPolicy `json:"eviction"`
+	Refresh   *refreshConf   `json:"refresh"`
 }
 
 func (c imageConfEntry) DelayDuration() time.Duration {
 	d, err := time.ParseDuration(fmt.Sprintf("%dms", c.Delay))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Bad millisecond configuration: %w", err)
+		fmt.Fprintf(os.Stderr, "Bad millisecond configuration: %s\n", err)
 		return 0
 	}
 	return d
@@ -362,7 +369,17 @@ func getConfFromHostname(hostname string) (entry imageConfEntry) {
 			if entry.Voffset == 0 {
 				entry.Voffset = hostnameEntry.Voffset
 			}
-			if entry.Delay != 0 && entry.Voffset != 0 {
+			if entry.Canonical == nil {
+				entry.Canonical = hostnameEntry.Canonical
+			}
+			if entry.Eviction == "" {
+				entry.Eviction = hostnameEntry.Eviction
+			}
+			if entry.Refresh == nil {
+				entry.Refresh = hostnameEntry.Refresh
+			}
+			if entry.Delay != 0 && entry.Voffset != 0 && entry.Canonical != nil &&
+				entry.Eviction != "" && entry.Refresh != nil {
 				return entry
 			}
 		}
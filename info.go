@@ -8,8 +8,10 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/jobindex/spectura/xlib"
@@ -19,6 +21,21 @@ type RenderableInfo struct {
 	CacheEntries  []CacheEntry
 	TotalSize     string
 	TotalEntries  int
+	CacheBudget   string
+	BudgetUsage   string
+	Evictions     int64
+	RefreshQueue  string
+	DecapBudget   string
+	RefreshTasks  []RefreshTask
+	QueueURL      string
+	RollbackURL   string
+	PinURL        string
+	UnpinURL      string
+	Warmup        *WarmupProgress
+	Namespace     string
+	Tag           string
+	PurgeURL      string
+	RefreshURL    string
 	OGImageHeight int
 	OGImageWidth  int
 }
@@ -57,22 +74,62 @@ func infoHandler(w http.ResponseWriter, req *http.Request) {
 	sort.SliceStable(entries, func(i, j int) bool {
 		return entries[i].EntryCreated.After(entries[j].EntryCreated)
 	})
-	size := 0
-	for _, entry := range entries {
-		size += len(entry.Image)
-	}
+	size := cache.Size()
+	totalEntries := len(entries)
+
+	// The ns and tag query params filter the listed entries
+	ns, tag := query.Get("ns"), query.Get("tag")
+	entries = slices.DeleteFunc(entries, func(e CacheEntry) bool {
+		return !e.Matches(ns, tag)
+	})
 
 	var entryLimit = limit
 	if limit > len(entries) {
 		entryLimit = len(entries)
 	}
+	tasks := cache.refreshQueue.Tasks()
+	decapBudget := "unlimited"
+	if interactiveBudget != nil {
+		decapBudget = fmt.Sprintf("interactive %s; background %s", interactiveBudget, backgroundBudget)
+	}
+	budget, usage := "unlimited", ""
+	if maxCacheSize > 0 {
+		budget = xlib.FmtByteSize(maxCacheSize, 2)
+		usage = fmt.Sprintf("%.1f%%", float64(size)*100/float64(maxCacheSize))
+	}
 	info := RenderableInfo{
 		entries[:entryLimit],
 		xlib.FmtByteSize(size, 2),
-		len(entries),
+		totalEntries,
+		budget,
+		usage,
+		cache.Evictions(),
+		cache.refreshQueue.String(),
+		decapBudget,
+		tasks[:min(limit, len(tasks))],
+		"",
+		"",
+		"",
+		"",
+		nil,
+		ns,
+		tag,
+		"",
+		"",
 		OGImageHeight,
 		OGImageWidth,
 	}
+	if warmupFile != "" {
+		info.Warmup = &warmup
+	}
+	if isAdmin(req) {
+		info.RollbackURL = adminURL(versionsPath)
+		info.PinURL = adminURL(pinPath)
+		info.UnpinURL = adminURL(unpinPath)
+		info.PurgeURL = adminURL(purgePath)
+		info.RefreshURL = adminURL(refreshPath)
+		info.QueueURL = adminURL(queuePath)
+	}
 	err := tmpl.Execute(w, info)
 	if err != nil {
 		errId := rand.Intn(int(math.Pow10(8)))
@@ -100,6 +157,69 @@ func (e *CacheEntry) SpecturaURL() string {
 	if useSignatures {
 		query.Set("s", e.Signature)
 	}
+	if e.Namespace != "" {
+		query.Set("ns", e.Namespace)
+	}
+	if len(e.Tags) > 0 {
+		query.Set("tags", strings.Join(e.Tags, ","))
+	}
 	specturaURL.RawQuery = query.Encode()
 	return specturaURL.String()
 }
+
+// FormatNextRefresh describes when e is due for an automatic refresh.
+func (e *CacheEntry) FormatNextRefresh() string {
+	next, ok := e.NextRefresh()
+	switch {
+	case e.Pinned:
+		return "never (pinned)"
+	case e.IsExpired():
+		return "never (expired)"
+	case !ok:
+		return "never (abandoned)"
+	case e.IsAutoRefreshDisabled():
+		return "never (disabled)"
+	}
+	desc := fmt.Sprintf("%s (every %s", formatDate(next), e.AutoRefreshInterval())
+	if conf := e.refreshConf(); conf != nil && len(conf.Windows) > 0 {
+		windows := make([]string, len(conf.Windows))
+		for i, w := range conf.Windows {
+			windows[i] = w.String()
+		}
+		desc += ", during " + strings.Join(windows, ", ")
+	}
+	return desc + ")"
+}
+
+// FilterURL returns the URL of the info page listing the entries in namespace
+// ns that have the given tag.
+func (info RenderableInfo) FilterURL(ns, tag string) string {
+	filterURL, _ := url.Parse(infoPath)
+	query := url.Values{}
+	if ns != "" {
+		query.Set("ns", ns)
+	}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	if info.PurgeURL != "" {
+		query.Set("token", adminToken)
+	}
+	filterURL.RawQuery = query.Encode()
+	return filterURL.String()
+}
+
+// adminURL returns the URL of the admin endpoint at path, including the admin
+// token.
+func adminURL(path string) string {
+	u, _ := url.Parse(path)
+	u.RawQuery = url.Values{"token": {adminToken}}.Encode()
+	return u.String()
+}
+
+// ImageURL returns the URL of the image of v.
+func (v ImageVersion) ImageURL() string {
+	imageURL, _ := url.Parse(imagePath)
+	imageURL.RawQuery = url.Values{"hash": {v.ImageHash}}.Encode()
+	return imageURL.String()
+}
@@ -4,6 +4,7 @@ import (
 	"crypto/hmac"
 	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -11,32 +12,75 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
+// lastFetchedPrecision is how old LastFetched of an entry must be before a
+// cache hit updates it.
+const lastFetchedPrecision = time.Minute
+
 const (
 	port           = 19165
 	screenshotPath = "/api/spectura/v0/screenshot"
 	infoPath       = "/api/spectura/v0/info"
+	snapshotPath   = "/api/spectura/v0/snapshot"
+	versionsPath   = "/api/spectura/v0/versions"
+	imagePath      = "/api/spectura/v0/image"
+	pinPath        = "/api/spectura/v0/pin"
+	unpinPath      = "/api/spectura/v0/unpin"
+	purgePath      = "/api/spectura/v0/purge"
+	refreshPath    = "/api/spectura/v0/refresh"
+	queuePath      = "/api/spectura/v0/queue"
+	entryPath      = "/api/spectura/v0/entry"
 )
 
 var (
 	autoRefreshAfter         time.Duration
 	autoRefreshHostBlacklist []string
+	autoRefreshMax           time.Duration
+	autoRefreshMin           time.Duration
 	bgRateLimitTime          time.Duration
+	cacheBackend             string
+	cacheDir                 string
 	cacheTTL                 time.Duration
 	decapURL                 string
+	expiredGracePeriod       time.Duration
+	failureMaxAttempts       int
+	failureRetryBase         time.Duration
+	failureRetryMax          time.Duration
+	freshWindow              time.Duration
 	adminToken               string
 	ignoreBackgroundRequests bool
+	imageHistorySize         int
+	captureHistorySize       int
+	maxCacheSize             int
 	maxImageSize             int
+	hostRefreshConcurrency   int
+	hostRefreshSpacing       time.Duration
+	refreshQueueSize         int
+	refreshWorkers           int
 	refreshTaskDelay         time.Duration
+	s3AccessKeyID            string
+	s3Bucket                 string
+	s3Endpoint               string
+	s3Prefix                 string
+	s3Region                 string
+	s3SecretAccessKey        string
 	scheduleInterval         time.Duration
+	shutdownTimeout          time.Duration
+	queueStateFile           string
 	signingKey               string
 	signingSecret            string
 	signingUniqueName        string
+	staleWindow              time.Duration
 	useSignatures            bool
+	warmupFile               string
+	warmupInterval           time.Duration
 	webhookURL               string
 	webhookAuthHeader        string
 )
@@ -46,6 +90,18 @@ var cache Cache
 func main() {
 	rand.Seed(time.Now().UnixNano())
 
+	if len(os.Args) > 1 {
+		switch cmd := os.Args[1]; cmd {
+		case "export", "import":
+			if err := snapshotCommand(cmd, os.Args[2:]); err != nil {
+				log.Fatalf("%s failed: %s", cmd, err)
+			}
+			return
+		default:
+			log.Fatalf("Unknown command %q (expected export or import)", cmd)
+		}
+	}
+
 	cacheTTLString, _ := getenv("CACHE_TTL", "48h")
 	var err error
 	cacheTTL, err = time.ParseDuration(cacheTTLString)
@@ -53,6 +109,12 @@ func main() {
 		log.Fatalf(`CACHE_TTL must be a valid duration such as "12h": %s\n`, err)
 	}
 
+	evictionPolicyString, _ := getenv("EVICTION_POLICY", "fixed")
+	globalEvictionPolicy, err = parseEvictionPolicy(evictionPolicyString)
+	if err != nil {
+		log.Fatalf("EVICTION_POLICY must be fixed, sliding or expire: %s\n", err)
+	}
+
 	scheduleIntervalString, _ := getenv("SCHEDULE_INTERVAL", "5m")
 	scheduleInterval, err = time.ParseDuration(scheduleIntervalString)
 	if err != nil {
@@ -65,6 +127,52 @@ func main() {
 		log.Fatalf(`AUTO_REFRESH_AFTER must be a valid duration such as "12h": %s\n`, err)
 	}
 
+	autoRefreshMinString, _ := getenv("AUTO_REFRESH_MIN", min(time.Hour, autoRefreshAfter).String())
+	autoRefreshMin, err = time.ParseDuration(autoRefreshMinString)
+	if err != nil {
+		log.Fatalf(`AUTO_REFRESH_MIN must be a valid duration such as "1h": %s\n`, err)
+	}
+
+	autoRefreshMaxString, _ := getenv("AUTO_REFRESH_MAX", max(48*time.Hour, autoRefreshAfter).String())
+	autoRefreshMax, err = time.ParseDuration(autoRefreshMaxString)
+	if err != nil {
+		log.Fatalf(`AUTO_REFRESH_MAX must be a valid duration such as "48h": %s\n`, err)
+	}
+	if autoRefreshMin > autoRefreshAfter || autoRefreshAfter > autoRefreshMax {
+		log.Fatalf("AUTO_REFRESH_AFTER (%s) must be between AUTO_REFRESH_MIN (%s) and AUTO_REFRESH_MAX (%s)",
+			autoRefreshAfter, autoRefreshMin, autoRefreshMax)
+	}
+
+	failureRetryBaseString, _ := getenv("FAILURE_RETRY_BASE", "5m")
+	failureRetryBase, err = time.ParseDuration(failureRetryBaseString)
+	if err != nil {
+		log.Fatalf(`FAILURE_RETRY_BASE must be a valid duration such as "5m": %s\n`, err)
+	}
+
+	failureRetryMaxString, _ := getenv("FAILURE_RETRY_MAX", "6h")
+	failureRetryMax, err = time.ParseDuration(failureRetryMaxString)
+	if err != nil {
+		log.Fatalf(`FAILURE_RETRY_MAX must be a valid duration such as "6h": %s\n`, err)
+	}
+
+	failureMaxAttemptsString, _ := getenv("FAILURE_MAX_ATTEMPTS", "8")
+	failureMaxAttempts, err = strconv.Atoi(failureMaxAttemptsString)
+	if err != nil {
+		log.Fatalf("FAILURE_MAX_ATTEMPTS must be a number: %s \n", err)
+	}
+
+	freshWindowString, _ := getenv("FRESH_WINDOW", "6h")
+	freshWindow, err = time.ParseDuration(freshWindowString)
+	if err != nil {
+		log.Fatalf(`FRESH_WINDOW must be a valid duration such as "6h": %s\n`, err)
+	}
+
+	staleWindowString, _ := getenv("STALE_WINDOW", "42h")
+	staleWindow, err = time.ParseDuration(staleWindowString)
+	if err != nil {
+		log.Fatalf(`STALE_WINDOW must be a valid duration such as "42h": %s\n`, err)
+	}
+
 	autoRefreshHostBlacklistString, _ := getenv("AUTO_REFRESH_HOST_BLACKLIST", "")
 	autoRefreshHostBlacklist = strings.Split(autoRefreshHostBlacklistString, ",")
 
@@ -74,6 +182,66 @@ func main() {
 		log.Fatalf(`REFRESH_TASK_DELAY must be a valid duration such as "12h": %s\n`, err)
 	}
 
+	refreshQueueSizeString, _ := getenv("REFRESH_QUEUE_SIZE", "1000")
+	refreshQueueSize, err = strconv.Atoi(refreshQueueSizeString)
+	if err != nil || refreshQueueSize < 1 {
+		log.Fatalf("REFRESH_QUEUE_SIZE must be a positive number: %s\n", refreshQueueSizeString)
+	}
+
+	refreshWorkersString, _ := getenv("REFRESH_WORKERS", "4")
+	refreshWorkers, err = strconv.Atoi(refreshWorkersString)
+	if err != nil || refreshWorkers < 1 {
+		log.Fatalf("REFRESH_WORKERS must be a positive number: %s\n", refreshWorkersString)
+	}
+
+	hostRefreshConcurrencyString, _ := getenv("HOST_REFRESH_CONCURRENCY", "1")
+	hostRefreshConcurrency, err = strconv.Atoi(hostRefreshConcurrencyString)
+	if err != nil || hostRefreshConcurrency < 1 {
+		log.Fatalf("HOST_REFRESH_CONCURRENCY must be a positive number: %s\n", hostRefreshConcurrencyString)
+	}
+
+	hostRefreshSpacingString, _ := getenv("HOST_REFRESH_SPACING", "0s")
+	hostRefreshSpacing, err = time.ParseDuration(hostRefreshSpacingString)
+	if err != nil {
+		log.Fatalf(`HOST_REFRESH_SPACING must be a valid duration such as "10s": %s\n`, err)
+	}
+
+	expiredGracePeriodString, _ := getenv("EXPIRED_GRACE_PERIOD", "24h")
+	expiredGracePeriod, err = time.ParseDuration(expiredGracePeriodString)
+	if err != nil {
+		log.Fatalf(`EXPIRED_GRACE_PERIOD must be a valid duration such as "24h": %s\n`, err)
+	}
+
+	warmupFile, _ = getenv("WARMUP_FILE", "")
+	warmupIntervalString, _ := getenv("WARMUP_INTERVAL", "5s")
+	warmupInterval, err = time.ParseDuration(warmupIntervalString)
+	if err != nil {
+		log.Fatalf(`WARMUP_INTERVAL must be a valid duration such as "5s": %s\n`, err)
+	}
+
+	decapRateString, _ := getenv("DECAP_RATE", "0")
+	decapRate, err := strconv.ParseFloat(decapRateString, 64)
+	if err != nil || decapRate < 0 {
+		log.Fatalf("DECAP_RATE must be a number of captures per minute, or 0 for no limit: %s\n", decapRateString)
+	}
+	decapBurstString, _ := getenv("DECAP_BURST", "10")
+	decapBurst, err := strconv.ParseFloat(decapBurstString, 64)
+	if err != nil || decapBurst < 1 {
+		log.Fatalf("DECAP_BURST must be a number of captures of at least 1: %s\n", decapBurstString)
+	}
+	decapBackgroundShareString, _ := getenv("DECAP_BACKGROUND_SHARE", "25")
+	decapBackgroundShare, err := strconv.Atoi(decapBackgroundShareString)
+	if err != nil || decapBackgroundShare <= 0 || decapBackgroundShare >= 100 {
+		log.Fatalf("DECAP_BACKGROUND_SHARE must be a percentage between 1 and 99: %s\n", decapBackgroundShareString)
+	}
+	interactiveBudget, backgroundBudget = newDecapBudget(decapRate, decapBurst, decapBackgroundShare)
+
+	shutdownTimeoutString, _ := getenv("SHUTDOWN_TIMEOUT", "30s")
+	shutdownTimeout, err = time.ParseDuration(shutdownTimeoutString)
+	if err != nil {
+		log.Fatalf(`SHUTDOWN_TIMEOUT must be a valid duration such as "30s": %s\n`, err)
+	}
+
 	bgRateLimitTimeString, _ := getenv("BG_RATE_LIMIT_TIME", "3h")
 	bgRateLimitTime, err = time.ParseDuration(bgRateLimitTimeString)
 	if err != nil {
@@ -88,6 +256,25 @@ func main() {
 	const bytesInMiB = 1 << 20
 	maxImageSize = bytesInMiB * maxImageSizeMiB
 
+	imageHistorySizeString, _ := getenv("IMAGE_HISTORY_SIZE", "3")
+	imageHistorySize, err = strconv.Atoi(imageHistorySizeString)
+	if err != nil {
+		log.Fatalf("IMAGE_HISTORY_SIZE must be a number: %s \n", err)
+	}
+
+	captureHistorySizeString, _ := getenv("CAPTURE_HISTORY_SIZE", "10")
+	captureHistorySize, err = strconv.Atoi(captureHistorySizeString)
+	if err != nil {
+		log.Fatalf("CAPTURE_HISTORY_SIZE must be a number: %s \n", err)
+	}
+
+	maxCacheSizeString, _ := getenv("MAX_CACHE_SIZE_MIB", "1024")
+	maxCacheSizeMiB, err := strconv.Atoi(maxCacheSizeString)
+	if err != nil {
+		log.Fatalf("MAX_CACHE_SIZE_MIB must be a number: %s \n", err)
+	}
+	maxCacheSize = bytesInMiB * maxCacheSizeMiB
+
 	decapURL, err = getenv("DECAP_URL", "http://localhost:4531")
 	if err != nil {
 		log.Fatal(err)
@@ -117,20 +304,83 @@ func main() {
 	webhookURL, _ = getenv("WEBHOOK_URL")
 	webhookAuthHeader, _ = getenv("WEBHOOK_AUTHORIZATION_HEADER")
 
-	cache.Init()
+	cacheDir, _ = getenv("CACHE_DIR", "")
+	if cacheDir != "" {
+		cacheBackend, _ = getenv("CACHE_BACKEND", "fs")
+		queueStateFile, _ = getenv("QUEUE_STATE_FILE", filepath.Join(cacheDir, "queue.json"))
+	} else {
+		cacheBackend, _ = getenv("CACHE_BACKEND", "memory")
+		queueStateFile, _ = getenv("QUEUE_STATE_FILE", "")
+	}
+	if cacheBackend == "s3" {
+		for key, value := range map[string]*string{
+			"S3_ENDPOINT":          &s3Endpoint,
+			"S3_BUCKET":            &s3Bucket,
+			"S3_ACCESS_KEY_ID":     &s3AccessKeyID,
+			"S3_SECRET_ACCESS_KEY": &s3SecretAccessKey,
+		} {
+			if *value, err = getenv(key); err != nil {
+				log.Fatalf("%s (required by CACHE_BACKEND=s3)", err)
+			}
+		}
+		s3Region, _ = getenv("S3_REGION", "us-east-1")
+		s3Prefix, _ = getenv("S3_PREFIX", "")
+	}
+
+	canonicalOptions, _ := getenv("URL_CANONICALIZATION", "")
+	canonicalDropParams, _ := getenv("URL_DROP_PARAMS", "")
+	if err = parseCanonicalOptions(canonicalOptions, canonicalDropParams); err != nil {
+		log.Fatalf("URL_CANONICALIZATION must be a list of canonicalization options: %s", err)
+	}
+
+	// The image configuration must be loaded before the cache, since it
+	// affects the cache keys.
 	if err = loadImageConf(); err != nil {
 		log.Fatalf(`Couldn't load image configuration from "%s": %s`, imageConfPath, err)
 	}
 
+	store, err := newCacheStore(cacheBackend)
+	if err != nil {
+		log.Fatalf("Couldn't initialize cache: %s", err)
+	}
+	cache.Init(store)
+	if queueStateFile != "" {
+		restoreRefreshQueue(queueStateFile)
+	}
+	if warmupFile != "" {
+		warmup.File = warmupFile
+		go warmUp(warmupFile)
+	}
+
 	http.HandleFunc("/", http.NotFound)
 	http.Handle(screenshotPath, http.HandlerFunc(screenshotHandler))
 	http.Handle(infoPath, http.HandlerFunc(infoHandler))
+	http.Handle(snapshotPath, http.HandlerFunc(snapshotHandler))
+	http.Handle(versionsPath, http.HandlerFunc(versionsHandler))
+	http.Handle(imagePath, http.HandlerFunc(imageHandler))
+	http.Handle(pinPath, http.HandlerFunc(pinHandler))
+	http.Handle(unpinPath, http.HandlerFunc(pinHandler))
+	http.Handle(purgePath, http.HandlerFunc(selectionHandler))
+	http.Handle(refreshPath, http.HandlerFunc(selectionHandler))
+	http.Handle(queuePath, http.HandlerFunc(queueHandler))
+	http.Handle(entryPath, http.HandlerFunc(entryHandler))
 
 	fmt.Fprintf(os.Stderr,
 		"%s spectura is listening on http://localhost:%d%s\n",
 		time.Now().Format("[15:04:05]"), port, screenshotPath,
 	)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", port), nil))
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port)}
+	go func() {
+		if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	fmt.Fprintf(os.Stderr, "%s Received %s, shutting down\n", time.Now().Format("[15:04:05]"), sig)
+	shutdown(server)
 }
 
 func getenv(key string, fallback ...string) (string, error) {
@@ -147,6 +397,12 @@ func getenv(key string, fallback ...string) (string, error) {
 	return "", fmt.Errorf("missing environment variable %s", key)
 }
 
+// isAdmin reports whether req carries the admin token.
+func isAdmin(req *http.Request) bool {
+	token := req.URL.Query().Get("token")
+	return token != "" && token == adminToken
+}
+
 // Check a JIX::UrlSignature hash signature
 func checkSignature(url string, signature string, expire string) bool {
 	h := hmac.New(sha1.New, []byte(signingKey))
@@ -186,7 +442,14 @@ func screenshotHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	if useSignatures && !checkSignature(targetURL.String(), signature, expireRaw) {
+	namespace, tagsRaw := query.Get("ns"), query.Get("tags")
+	tags, err := parseTags(tagsRaw)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if useSignatures && !checkSignature(signedURL(targetURL.String(), namespace, tagsRaw), signature, expireRaw) {
 		http.Error(w, "Signature check failed", http.StatusBadRequest)
 		return
 	}
@@ -200,7 +463,13 @@ func screenshotHandler(w http.ResponseWriter, req *http.Request) {
 	if query.Get("nocrop") != "" && !useSignatures {
 		entry := CacheEntry{URL: targetURL}
 		fmt.Fprintf(os.Stderr, "Cache-miss (nocrop): %s\n", entry.URL)
-		err = entry.fetchAndCropImage(false, true)
+		// Uncropped captures aren't cached or shared, but still draw from
+		// the Decap budget like other captures for a waiting request
+		if !interactiveBudget.take() {
+			http.Error(w, errDecapBudget.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		_, err = entry.fetchAndCropImage(false, true)
 		if err != nil {
 			msg := fmt.Sprintf("nocrop fail: %s", err)
 			http.Error(w, msg, http.StatusInternalServerError)
@@ -211,7 +480,18 @@ func screenshotHandler(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	entry := cache.Read(targetURL.String())
+	// The signature is checked against the original URL above, but the cache
+	// is keyed on the canonical URL, so variants of a URL share an entry.
+	entry := cache.Read(cacheKey(targetURL))
+	// signed holds the signed params of the request, which may extend the
+	// life of the entry or tag it (see adoptSigned)
+	signed := CacheEntry{
+		Expire:    time.Unix(expire, 0),
+		Signature: signature,
+		URL:       targetURL,
+		Namespace: namespace,
+		Tags:      tags,
+	}
 
 	if query.Get("bg") != "" {
 		if ignoreBackgroundRequests {
@@ -222,21 +502,33 @@ func screenshotHandler(w http.ResponseWriter, req *http.Request) {
 			entry.Expire = time.Unix(expire, 0)
 			entry.Signature = signature
 			entry.URL = targetURL
+			entry.Namespace = namespace
+			entry.Tags = tags
+		} else if entry.Pinned {
+			http.Error(w, "Pinned entries aren't refreshed", http.StatusConflict)
+			return
 		} else {
-			admin := query.Get("token") != "" && query.Get("token") == adminToken
 			elapsed := time.Since(entry.LastRefreshAttempt)
-			if !admin && elapsed < bgRateLimitTime {
+			if !isAdmin(req) && elapsed < bgRateLimitTime {
 				msg := fmt.Sprintf("%s since last background request", elapsed)
 				http.Error(w, msg, http.StatusTooManyRequests)
 				return
 			}
 		}
 
+		entry.adoptSigned(signed)
 		// Create cache entry / update timestamp, so repeated background queries
 		// can be rejected while this query is queued.
 		cache.WriteMetadata(entry)
 
-		go cache.runRefreshTask(entry)
+		priority := PriorityBackground
+		if isAdmin(req) {
+			priority = PriorityAdmin
+		}
+		if err = cache.queueRefresh(entry, priority); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
 		fmt.Fprint(w, "Success, refresh is now in progress. This can take up to 30 seconds.\n")
 		return
 	}
@@ -248,27 +540,99 @@ func screenshotHandler(w http.ResponseWriter, req *http.Request) {
 			Provenance:  newProvenance(req),
 			Signature:   signature,
 			URL:         targetURL,
+			Namespace:   namespace,
+			Tags:        tags,
 		}
 		fmt.Fprintf(os.Stderr, "Cache miss: %s\n", entry.URL)
-		err = entry.fetchAndCropImage(false, false)
+		var attempt CaptureAttempt
+		var shared bool
+		attempt, shared, err = cache.capture(&entry, false)
 		switch {
 		case err == nil:
 			cache.Write(entry)
+			if !shared {
+				cache.recordCapture(entry.Key(), attempt, err)
+			}
+			w.Header().Set(freshnessHeader, string(Fresh))
 		case errors.Is(err, croppingError) || errors.Is(err, decapInternalError):
 			cache.WriteMetadata(entry)
-			entry = cache.Read(entry.URL.String())
+			if !shared {
+				cache.recordCapture(entry.Key(), attempt, err)
+			}
+			entry = cache.Read(entry.Key())
+			w.Header().Set(freshnessHeader, string(Missing))
+		case errors.Is(err, errDecapBudget):
+			// Serve the fallback image rather than waiting for Decap, and
+			// capture the image in the background instead
+			fmt.Fprintf(os.Stderr, "Serving fallback image: %s\n", err)
+			cache.WriteMetadata(entry)
+			entry = cache.Read(entry.Key())
+			w.Header().Set(freshnessHeader, string(Missing))
 		default:
+			// The error may be transient, so no entry is created, which would
+			// serve the fallback image until the retry backoff has passed.
+			// The next request tries again instead.
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		go cache.runRefreshTask(entry)
+		// Only the request that did the capture schedules a refresh
+		if !shared {
+			cache.queueRefresh(entry, PriorityRetry)
+		}
 	} else if !strings.Contains(req.Referer(), infoPath) {
-		fmt.Fprintf(os.Stderr, "Cache hit: %s\n", entry.URL)
-		if entry.Provenance.when.IsZero() {
-			entry.Provenance = newProvenance(req)
+		adopted := entry.adoptSigned(signed)
+		// LastFetched only needs to be as precise as eviction, so it's not
+		// written to the store on every hit
+		if entry.Provenance.when.IsZero() || adopted || time.Since(entry.LastFetched) >= lastFetchedPrecision {
+			if entry.Provenance.when.IsZero() {
+				entry.Provenance = newProvenance(req)
+			}
+			entry.LastFetched = time.Now()
+			cache.WriteMetadata(entry)
 		}
-		entry.LastFetched = time.Now()
-		cache.WriteMetadata(entry)
+		if adopted && entry.IsExpired() && time.Now().Before(entry.Expire) {
+			fmt.Fprintf(os.Stderr, "Cache entry no longer expired: %s\n", entry.URL)
+			entry = cache.Read(entry.Key())
+			// The image may have been freed while the entry was expired
+			if entry.IsFailedImage() {
+				cache.queueRefresh(entry, PriorityRetry)
+			}
+		}
+		freshness := entry.Freshness()
+		fmt.Fprintf(os.Stderr, "Cache hit (%s): %s\n", freshness, entry.URL)
+
+		switch freshness {
+		case Stale:
+			// Serve the stale image right away, and refresh it for later
+			if entry.MayRefresh() && cache.queueRefresh(entry, PriorityBackground) == nil {
+				freshness = Revalidating
+			}
+		case Outdated:
+			// Too old to be served, unless no newer image can be captured
+			if !entry.MayRefresh() {
+				break
+			}
+			fresh := entry
+			var attempt CaptureAttempt
+			var shared bool
+			attempt, shared, err = cache.capture(&fresh, false)
+			if !shared {
+				cache.recordCapture(entry.Key(), attempt, err)
+			}
+			if err == nil {
+				cache.Write(fresh)
+				entry = cache.Read(entry.Key())
+				freshness = entry.Freshness()
+			} else {
+				fmt.Fprintf(os.Stderr, "Serving outdated image after failed capture: %s\n", err)
+				if errors.Is(err, errDecapBudget) {
+					cache.queueRefresh(entry, PriorityBackground)
+				}
+			}
+		}
+		w.Header().Set(freshnessHeader, string(freshness))
+	} else {
+		w.Header().Set(freshnessHeader, string(entry.Freshness()))
 	}
 	w.Header().Set("Content-Type", "image/png")
 	w.Write(entry.Image)
@@ -290,6 +654,27 @@ func newProvenance(req *http.Request) Provenance {
 	}
 }
 
+// provenanceJSON is the serializable form of a Provenance.
+type provenanceJSON struct {
+	Addr      string
+	Referer   string
+	UserAgent string
+	When      time.Time
+}
+
+func (p Provenance) MarshalJSON() ([]byte, error) {
+	return json.Marshal(provenanceJSON{p.addr, p.referer, p.userAgent, p.when})
+}
+
+func (p *Provenance) UnmarshalJSON(data []byte) error {
+	var v provenanceJSON
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*p = Provenance{v.Addr, v.Referer, v.UserAgent, v.When}
+	return nil
+}
+
 func (p Provenance) String() string {
 	if p.when.IsZero() {
 		return p.when.Format(time.UnixDate)
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// parseTags splits the comma-separated tags query param. Tags can't be empty.
+func parseTags(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	tags := strings.Split(raw, ",")
+	if slices.Contains(tags, "") {
+		return nil, fmt.Errorf(`Query param "tags" must be a comma-separated list of non-empty tags`)
+	}
+	return tags, nil
+}
+
+// signedURL returns the string covered by the signature of a screenshot
+// request. Without the ns and tags query params, that's just the URL, so
+// existing signatures stay valid. URLs can't contain newlines, so the
+// namespace and tags can't be moved into the URL without breaking the
+// signature.
+func signedURL(rawURL, ns, tags string) string {
+	if ns == "" && tags == "" {
+		return rawURL
+	}
+	return rawURL + "\nns=" + ns + "\ntags=" + tags
+}
+
+// signedURL returns the string covered by the signature of e.
+func (e *CacheEntry) signedURL() string {
+	return signedURL(e.URL.String(), e.Namespace, strings.Join(e.Tags, ","))
+}
+
+// Matches reports whether e is in namespace ns and has the given tag. Empty
+// arguments match any entry.
+func (e *CacheEntry) Matches(ns, tag string) bool {
+	return (ns == "" || e.Namespace == ns) && (tag == "" || slices.Contains(e.Tags, tag))
+}
+
+// Select returns the entries in namespace ns that have the given tag.
+func (c *Cache) Select(ns, tag string) []CacheEntry {
+	return slices.DeleteFunc(c.ReadAll(), func(e CacheEntry) bool {
+		return !e.Matches(ns, tag)
+	})
+}
+
+// Purge deletes the entries in namespace ns that have the given tag, except
+// pinned ones. It returns the number of deleted entries.
+func (c *Cache) Purge(ns, tag string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	purged := 0
+	c.store.Range(func(key string, entry CacheEntry) bool {
+		if entry.Matches(ns, tag) && !entry.IsProtected() {
+			c.delete(key, entry)
+			purged++
+		}
+		return true
+	})
+	return purged
+}
+
+// selectionHandler purges or refreshes all entries with the namespace and tag
+// given by the "ns" and "tag" query params, depending on the request path.
+func selectionHandler(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ns, tag := req.FormValue("ns"), req.FormValue("tag")
+	if ns == "" && tag == "" {
+		http.Error(w, `Query param "ns" or "tag" must be present`, http.StatusBadRequest)
+		return
+	}
+
+	var msg string
+	switch req.URL.Path {
+	case purgePath:
+		n := cache.Purge(ns, tag)
+		msg = fmt.Sprintf("Purged %d entries", n)
+	case refreshPath:
+		entries := cache.Select(ns, tag)
+		queued, pinned, running := 0, 0, 0
+		for _, entry := range entries {
+			// queueRefresh doesn't report pinned entries and running
+			// refreshes as errors
+			switch {
+			case entry.Pinned:
+				pinned++
+			case cache.refreshQueue.isRunning(entry.Key()):
+				running++
+			case cache.queueRefresh(entry, PriorityAdmin) == nil:
+				queued++
+			}
+		}
+		msg = fmt.Sprintf("Queued refresh of %d of %d entries (%d pinned, %d already running)",
+			queued, len(entries), pinned, running)
+	}
+	fmt.Fprintf(os.Stderr, "%s (ns %q, tag %q)\n", msg, ns, tag)
+	if strings.Contains(req.Referer(), infoPath) {
+		http.Redirect(w, req, req.Referer(), http.StatusSeeOther)
+		return
+	}
+	fmt.Fprintln(w, msg)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// IsProtected reports whether e is pinned and not yet expired. Protected
+// entries aren't refreshed, evicted or cleared, and merge never replaces
+// their image.
+func (e *CacheEntry) IsProtected() bool {
+	return e.Pinned && !e.IsExpired()
+}
+
+// SetPinned pins or unpins the entry at key.
+func (c *Cache) SetPinned(key string, pinned bool) error {
+	found := c.update(key, func(e *CacheEntry) bool {
+		if e.Pinned == pinned {
+			return false
+		}
+		e.Pinned = pinned
+		return true
+	})
+	if !found {
+		return errNotCached
+	}
+	verb := "Unpinned"
+	if pinned {
+		verb = "Pinned"
+	}
+	fmt.Fprintf(os.Stderr, "%s cache entry %s\n", verb, key)
+	return nil
+}
+
+// pinHandler pins the cache entry for the URL given by the "url" query param,
+// or unpins it if the request is for unpinPath.
+func pinHandler(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	targetURL, err := url.Parse(req.FormValue("url"))
+	if err != nil || targetURL.String() == "" {
+		http.Error(w, `Query param "url" must be a valid URL`, http.StatusBadRequest)
+		return
+	}
+	pinned := req.URL.Path != unpinPath
+	err = cache.SetPinned(cacheKey(targetURL), pinned)
+	switch {
+	case errors.Is(err, errNotCached):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	case strings.Contains(req.Referer(), infoPath):
+		http.Redirect(w, req, req.Referer(), http.StatusSeeOther)
+	case pinned:
+		fmt.Fprintln(w, "Pinned")
+	default:
+		fmt.Fprintln(w, "Unpinned")
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// retryBackoff returns how long to wait before retrying a capture that has
+// failed attempts times in a row. The delay doubles with every failure,
+// starting at failureRetryBase and capped at failureRetryMax.
+func retryBackoff(attempts int) time.Duration {
+	delay := failureRetryBase
+	for i := 1; i < attempts && delay < failureRetryMax; i++ {
+		delay *= 2
+	}
+	return min(delay, failureRetryMax)
+}
+
+// IsAbandoned reports whether capturing e has failed so many times in a row
+// that it's no longer refreshed automatically.
+func (e *CacheEntry) IsAbandoned() bool {
+	return failureMaxAttempts > 0 && e.FailedAttempts >= failureMaxAttempts
+}
+
+// AutoRefreshInterval returns the interval at which e is refreshed while
+// healthy. It starts out as autoRefreshAfter and is adapted to how often the
+// image of e changes (see adaptRefreshInterval), within autoRefreshMin and
+// autoRefreshMax, unless image_conf.json sets the interval for the host.
+func (e *CacheEntry) AutoRefreshInterval() time.Duration {
+	if conf := e.refreshConf(); conf != nil && conf.Interval > 0 {
+		return time.Duration(conf.Interval)
+	}
+	return e.adaptiveRefreshInterval()
+}
+
+func (e *CacheEntry) adaptiveRefreshInterval() time.Duration {
+	if e.RefreshInterval == 0 {
+		return autoRefreshAfter
+	}
+	return min(max(e.RefreshInterval, autoRefreshMin), autoRefreshMax)
+}
+
+// adaptRefreshInterval records a capture of e in its change history. If the
+// image changed, the refresh interval is halved, and otherwise it's increased
+// by half, so that entries that never change are refreshed rarely while
+// volatile ones are refreshed often.
+func (e *CacheEntry) adaptRefreshInterval(changed bool) {
+	interval := e.adaptiveRefreshInterval()
+	e.Captures++
+	if changed {
+		e.Changes++
+		interval /= 2
+	} else {
+		interval += interval / 2
+	}
+	e.RefreshInterval = min(max(interval, autoRefreshMin), autoRefreshMax)
+}
+
+// refreshConf returns the refresh settings for the host of e, or nil if there
+// are none.
+func (e *CacheEntry) refreshConf() *refreshConf {
+	return hostRefreshConf(e.URL.Hostname())
+}
+
+// IsAutoRefreshDisabled reports whether automatic refreshes of e are turned
+// off, by AUTO_REFRESH_HOST_BLACKLIST or by image_conf.json.
+func (e *CacheEntry) IsAutoRefreshDisabled() bool {
+	if conf := e.refreshConf(); conf != nil && conf.Disabled {
+		return true
+	}
+	return slices.Contains(autoRefreshHostBlacklist, e.URL.Host)
+}
+
+// NextRefresh returns the time at which e is due for an automatic refresh.
+// Healthy entries are refreshed every AutoRefreshInterval. After failed
+// captures, entries without an image are retried following retryBackoff, while
+// entries with an image keep it at least until the regular refresh. ok is
+// false if e has been abandoned.
+func (e *CacheEntry) NextRefresh() (next time.Time, ok bool) {
+	if e.IsAbandoned() {
+		return time.Time{}, false
+	}
+	interval := e.AutoRefreshInterval()
+	if e.FailedAttempts > 0 {
+		if e.IsFailedImage() {
+			interval = retryBackoff(e.FailedAttempts)
+		} else {
+			interval = max(retryBackoff(e.FailedAttempts), interval)
+		}
+	}
+	return e.LastRefreshAttempt.Add(interval), true
+}
+
+// MayRefresh reports whether a request for e may refresh its stale or outdated
+// image. Like automatic refreshes, that's not the case for abandoned entries
+// and entries whose automatic refreshes are disabled, and after failed
+// captures, the entry isn't refreshed before NextRefresh.
+func (e *CacheEntry) MayRefresh() bool {
+	if e.IsAbandoned() || e.IsAutoRefreshDisabled() {
+		return false
+	}
+	if e.FailedAttempts > 0 {
+		next, _ := e.NextRefresh()
+		return time.Now().After(next)
+	}
+	return true
+}
+
+// recordCapture records attempt, the capture of the entry at key which ended
+// with err, in the capture history of the entry, and counts consecutive
+// failures. The attempt counts as the last refresh attempt, so that the retry
+// backoff applies to captures made by requests as well. Captures that weren't
+// made because the Decap budget was exhausted aren't recorded.
+func (c *Cache) recordCapture(key string, attempt CaptureAttempt, err error) {
+	if errors.Is(err, errDecapBudget) {
+		return
+	}
+	c.update(key, func(e *CacheEntry) bool {
+		e.addAttempt(attempt)
+		if attempt.Time.After(e.LastRefreshAttempt) {
+			e.LastRefreshAttempt = attempt.Time
+		}
+		if err == nil {
+			e.FailedAttempts, e.LastError = 0, ""
+			return true
+		}
+		e.FailedAttempts++
+		e.LastError = err.Error()
+		return true
+	})
+}
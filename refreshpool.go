@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// refreshConf holds the per-host refresh settings of image_conf.json, given
+// by the "refresh" field. Unset fields fall back to the global settings.
+type refreshConf struct {
+	// Concurrency is the maximum number of refreshes running at once
+	Concurrency int `json:"concurrency"`
+	// Spacing is the minimum time between the starts of two refreshes
+	Spacing confDuration `json:"spacing"`
+	// Disabled turns off automatic refreshes
+	Disabled bool `json:"disabled"`
+	// Interval replaces the adaptive refresh interval
+	Interval confDuration `json:"interval"`
+	// Windows are the times of day during which refreshes may start
+	Windows []refreshWindow `json:"windows"`
+}
+
+// allowsAt reports whether the windows of c allow a refresh to start at t. A
+// nil refreshConf, or one without windows, allows refreshes at any time.
+func (c *refreshConf) allowsAt(t time.Time) bool {
+	if c == nil || len(c.Windows) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(c.Windows, func(w refreshWindow) bool {
+		return w.contains(t)
+	})
+}
+
+// A refreshWindow is a time of day, given as a string such as "20:00-06:00" in
+// image_conf.json. Windows ending before they start span midnight. Times are
+// in the local time zone of the server.
+type refreshWindow struct {
+	// start and end are the times since midnight
+	start, end time.Duration
+}
+
+func (w *refreshWindow) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	start, end, ok := strings.Cut(s, "-")
+	startTime, err := time.Parse("15:04", start)
+	if !ok || err != nil {
+		return fmt.Errorf("refresh window %q must be given as HH:MM-HH:MM", s)
+	}
+	endTime, err := time.Parse("15:04", end)
+	if err != nil || endTime.Equal(startTime) {
+		return fmt.Errorf("refresh window %q must be given as HH:MM-HH:MM", s)
+	}
+	w.start, w.end = sinceMidnight(startTime), sinceMidnight(endTime)
+	return nil
+}
+
+func (w refreshWindow) contains(t time.Time) bool {
+	d := sinceMidnight(t)
+	if w.start < w.end {
+		return w.start <= d && d < w.end
+	}
+	return d >= w.start || d < w.end
+}
+
+func (w refreshWindow) String() string {
+	midnight := time.Time{}
+	return midnight.Add(w.start).Format("15:04") + "-" + midnight.Add(w.end).Format("15:04")
+}
+
+func sinceMidnight(t time.Time) time.Duration {
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+}
+
+// A confDuration is a time.Duration given as a string such as "10s" in
+// image_conf.json.
+type confDuration time.Duration
+
+func (d *confDuration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	duration, err := time.ParseDuration(s)
+	*d = confDuration(duration)
+	return err
+}
+
+// refreshHost returns the host whose limits apply to refreshes of u. That's
+// the image_conf.json entry with refresh settings closest to the hostname of
+// u, so that the limits configured for e.g. "emply.net" are shared by all of
+// its subdomains, or else the hostname itself.
+func refreshHost(hostname string) string {
+	hostname = strings.ToLower(hostname)
+	for host := hostname; strings.Contains(host, "."); host = strings.SplitN(host, ".", 2)[1] {
+		if globalImageConf[host].Refresh != nil {
+			return host
+		}
+	}
+	return hostname
+}
+
+// hostRefreshConf returns the refresh settings for pages on host, or nil if
+// there are none.
+func hostRefreshConf(host string) *refreshConf {
+	return getConfFromHostname(strings.ToLower(host)).Refresh
+}
+
+// hostRefreshLimits returns the concurrency and spacing limits for refreshes
+// of pages on host (see refreshHost).
+func hostRefreshLimits(host string) (concurrency int, spacing time.Duration) {
+	concurrency, spacing = hostRefreshConcurrency, hostRefreshSpacing
+	if conf := hostRefreshConf(host); conf != nil {
+		if conf.Concurrency > 0 {
+			concurrency = conf.Concurrency
+		}
+		if conf.Spacing > 0 {
+			spacing = time.Duration(conf.Spacing)
+		}
+	}
+	return concurrency, spacing
+}
+
+// hostLimits tracks the running refreshes per host, to enforce the limits of
+// hostRefreshLimits. It's safe for concurrent use.
+type hostLimits struct {
+	mu      sync.Mutex
+	running map[string]int
+	started map[string]time.Time
+}
+
+func newHostLimits() *hostLimits {
+	return &hostLimits{
+		running: make(map[string]int),
+		started: make(map[string]time.Time),
+	}
+}
+
+// allows reports whether a refresh on host can be started now.
+func (l *hostLimits) allows(host string) bool {
+	concurrency, spacing := hostRefreshLimits(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.running[host] < concurrency && time.Since(l.started[host]) >= spacing
+}
+
+func (l *hostLimits) start(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.running[host]++
+	l.started[host] = time.Now()
+}
+
+func (l *hostLimits) done(host string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running[host]--; l.running[host] <= 0 {
+		delete(l.running, host)
+	}
+}
+
+// scheduleRefresh runs the queued refreshes on a pool of refreshWorkers
+// workers, starting at most one every refreshTaskDelay. Refreshes are started
+// in order, except that refreshes on hosts that have reached their limits, or
+// that are outside their refresh windows, are skipped until the host allows a
+// new one. Admin refreshes aren't held back by refresh windows.
+//
+// scheduleRefresh returns once the queue has been closed. The running
+// refreshes are tracked by c.tasks.
+func (c *Cache) scheduleRefresh() {
+	workers := make(chan struct{}, refreshWorkers)
+	for {
+		workers <- struct{}{}
+		item, ok := c.refreshQueue.next(func(item refreshItem) bool {
+			if item.priority != PriorityAdmin && !hostRefreshConf(item.host).allowsAt(time.Now()) {
+				return false
+			}
+			return c.hostLimits.allows(item.host)
+		}, &c.tasks)
+		if !ok {
+			return
+		}
+		c.hostLimits.start(item.host)
+		go func() {
+			defer c.tasks.Done()
+			c.runRefreshTask(item)
+			c.refreshQueue.done(item)
+			c.hostLimits.done(item.host)
+			<-workers
+			// Refreshes on the host may have been waiting for this one
+			c.refreshQueue.wake()
+		}()
+		time.Sleep(refreshTaskDelay)
+	}
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A RefreshPriority is the class of a queued refresh. Refreshes of a higher
+// class (lower value) are always started before those of a lower class.
+type RefreshPriority int
+
+const (
+	// PriorityAdmin is for refreshes requested with the admin token.
+	PriorityAdmin RefreshPriority = iota
+	// PriorityRetry is for refreshes of entries that don't have a proper image
+	// yet, i.e. the follow-up to a first capture and retries of failed ones.
+	PriorityRetry
+	// PriorityBackground is for refreshes caused by users, through background
+	// requests or by fetching stale images.
+	PriorityBackground
+	// PriorityAuto is for routine refreshes started by the cache itself.
+	PriorityAuto
+)
+
+var priorityNames = []string{"admin", "retry", "background", "auto"}
+
+func (p RefreshPriority) String() string {
+	return priorityNames[p]
+}
+
+var errRefreshQueueFull = errors.New("refresh queue is full")
+
+// refreshPollInterval is how often a refreshQueue waiting for an eligible item
+// checks again, since items become eligible as time passes.
+const refreshPollInterval = 500 * time.Millisecond
+
+// defaultRefreshDuration is the assumed duration of a refresh until one has
+// been timed, for estimating when queued refreshes start.
+const defaultRefreshDuration = 30 * time.Second
+
+var (
+	errNotQueued      = errors.New("Refresh isn't queued")
+	errRefreshRunning = errors.New("Refresh is already running")
+)
+
+// A refreshItem is a refresh waiting in a refreshQueue, or running after being
+// taken from it.
+type refreshItem struct {
+	key      string
+	host     string
+	entry    CacheEntry
+	priority RefreshPriority
+	// reason is the priority the refresh was queued with, before it was raised
+	reason  RefreshPriority
+	queued  time.Time
+	started time.Time
+	// uncached is set if the entry isn't cached until it has been captured,
+	// as with warm-up URLs, so that it isn't served before then
+	uncached bool
+}
+
+// A refreshQueue holds the refreshes waiting to be started, ordered by
+// priority and then by the time they were queued. It holds at most limit
+// items; when it's full, the lowest priority item is dropped to make room for
+// a higher priority one. It also keeps track of the running refreshes taken
+// from it, until they are done. It's safe for concurrent use.
+type refreshQueue struct {
+	mu      sync.Mutex
+	items   []refreshItem
+	running map[string]refreshItem
+	limit   int
+	dropped int64
+	// duration is a moving average of the duration of refreshes
+	duration time.Duration
+	// closed is set once no more items are taken from the queue
+	closed bool
+	// ready is signalled when an item is pushed
+	ready chan struct{}
+}
+
+func newRefreshQueue(limit int) *refreshQueue {
+	return &refreshQueue{
+		running:  make(map[string]refreshItem),
+		limit:    limit,
+		duration: defaultRefreshDuration,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+// push adds item to the queue. If the queue is full, either the last item or
+// item itself is dropped, and returned as dropped. ok is false if item was
+// dropped.
+func (q *refreshQueue) push(item refreshItem) (dropped *refreshItem, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) >= q.limit {
+		last := q.items[len(q.items)-1]
+		q.dropped++
+		if last.priority <= item.priority {
+			return &item, false
+		}
+		q.items = q.items[:len(q.items)-1]
+		dropped = &last
+	}
+	q.insert(item)
+	return dropped, true
+}
+
+// raise raises the priority of the queued item for the same entry as item to
+// that of item, if it's lower.
+func (q *refreshQueue) raise(item refreshItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.index(item.key)
+	if i < 0 || q.items[i].priority <= item.priority {
+		return
+	}
+	item.reason, item.queued = q.items[i].reason, q.items[i].queued
+	q.items = slices.Delete(q.items, i, i+1)
+	q.insert(item)
+}
+
+// bump moves the queued item for the entry at key to the front of the queue,
+// by raising its priority to PriorityAdmin.
+func (q *refreshQueue) bump(key string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.index(key)
+	if i < 0 {
+		return q.notQueued(key)
+	}
+	item := q.items[i]
+	item.priority = PriorityAdmin
+	q.items = slices.Delete(q.items, i, i+1)
+	q.insert(item)
+	return nil
+}
+
+// cancel removes the queued item for the entry at key.
+func (q *refreshQueue) cancel(key string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	i := q.index(key)
+	if i < 0 {
+		return q.notQueued(key)
+	}
+	q.items = slices.Delete(q.items, i, i+1)
+	return nil
+}
+
+// notQueued returns the error for an operation on the entry at key, which
+// isn't queued. The caller must hold q.mu.
+func (q *refreshQueue) notQueued(key string) error {
+	if _, running := q.running[key]; running {
+		return errRefreshRunning
+	}
+	return errNotQueued
+}
+
+// isRunning reports whether the refresh of the entry at key is running.
+func (q *refreshQueue) isRunning(key string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	_, running := q.running[key]
+	return running
+}
+
+// accepts reports whether an item with the given priority can be pushed
+// without being dropped. If not, the item counts as dropped.
+func (q *refreshQueue) accepts(priority RefreshPriority) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) < q.limit || q.items[len(q.items)-1].priority > priority {
+		return true
+	}
+	q.dropped++
+	return false
+}
+
+// insert adds item at its position and signals that the queue isn't empty.
+// The caller must hold q.mu.
+func (q *refreshQueue) insert(item refreshItem) {
+	i, _ := slices.BinarySearchFunc(q.items, item, compareRefreshItems)
+	q.items = slices.Insert(q.items, i, item)
+	q.wake()
+}
+
+// next removes and returns the first item of the queue for which eligible
+// returns true, which counts as running until done is called. If there is
+// none, it waits for one, checking again whenever an item is pushed, the queue
+// is woken up (see wake), or refreshPollInterval has passed. ok is false once
+// the queue has been closed.
+//
+// The item is added to tasks before the queue is unlocked, so that once close
+// has returned, waiting for tasks also waits for every item handed out.
+func (q *refreshQueue) next(eligible func(refreshItem) bool, tasks *sync.WaitGroup) (item refreshItem, ok bool) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return refreshItem{}, false
+		}
+		if i := slices.IndexFunc(q.items, eligible); i >= 0 {
+			item = q.items[i]
+			item.started = time.Now()
+			q.items = slices.Delete(q.items, i, i+1)
+			q.running[item.key] = item
+			tasks.Add(1)
+			q.mu.Unlock()
+			return item, true
+		}
+		q.mu.Unlock()
+		select {
+		case <-q.ready:
+		case <-time.After(refreshPollInterval):
+		}
+	}
+}
+
+// done marks item, returned by next, as no longer running.
+func (q *refreshQueue) done(item refreshItem) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.running, item.key)
+	q.duration += (time.Since(item.started) - q.duration) / 10
+}
+
+// close stops next from returning any more items. Items can still be pushed,
+// so that they are listed by Tasks.
+func (q *refreshQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	q.wake()
+}
+
+// wake makes a waiting call to next check the queue again.
+func (q *refreshQueue) wake() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// index returns the position of the item for the entry at key, or -1. The
+// caller must hold q.mu.
+func (q *refreshQueue) index(key string) int {
+	return slices.IndexFunc(q.items, func(item refreshItem) bool {
+		return item.key == key
+	})
+}
+
+// String summarizes the queue for the info page.
+func (q *refreshQueue) String() string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	counts := make([]int, len(priorityNames))
+	for _, item := range q.items {
+		counts[item.priority]++
+	}
+	var parts []string
+	for p, n := range counts {
+		if n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", n, RefreshPriority(p)))
+		}
+	}
+	summary := fmt.Sprintf("%d running, %d of %d queued", len(q.running), len(q.items), q.limit)
+	if len(parts) > 0 {
+		summary += " (" + strings.Join(parts, ", ") + ")"
+	}
+	return fmt.Sprintf("%s, %d dropped", summary, q.dropped)
+}
+
+func compareRefreshItems(a, b refreshItem) int {
+	if a.priority != b.priority {
+		return int(a.priority - b.priority)
+	}
+	return a.queued.Compare(b.queued)
+}
+
+// A RefreshTask describes a queued or running refresh.
+type RefreshTask struct {
+	URL      string    `json:"url"`
+	Priority string    `json:"priority"`
+	Reason   string    `json:"reason"`
+	Queued   time.Time `json:"queued"`
+	Running  bool      `json:"running"`
+	// Start is when the task started, or, if it's still queued, when it's
+	// estimated to start
+	Start time.Time `json:"start"`
+}
+
+// Tasks lists the running refreshes, by start time, followed by the queued
+// ones in order.
+//
+// The start of queued refreshes is estimated from their position in the queue,
+// the number of workers, the average duration of refreshes and the spacing of
+// refreshes on their host. The concurrency limits and refresh windows of each
+// host aren't taken into account, so some refreshes may start later than
+// estimated.
+func (q *refreshQueue) Tasks() []RefreshTask {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	tasks := make([]RefreshTask, 0, len(q.running)+len(q.items))
+	// lastStart is the latest start of a refresh per host
+	lastStart := make(map[string]time.Time)
+	for _, item := range q.running {
+		tasks = append(tasks, newRefreshTask(item, true, item.started))
+		if item.started.After(lastStart[item.host]) {
+			lastStart[item.host] = item.started
+		}
+	}
+	slices.SortFunc(tasks, func(a, b RefreshTask) int {
+		return a.Start.Compare(b.Start)
+	})
+
+	now := time.Now()
+	idle := refreshWorkers - len(q.running)
+	for i, item := range q.items {
+		// Refreshes are started every refreshTaskDelay while workers are idle,
+		// and then as workers become available
+		start := now.Add(max(time.Duration(i)*refreshTaskDelay, time.Duration(i+1-idle)*q.duration/time.Duration(refreshWorkers)))
+		// but no sooner than the spacing of their host allows
+		if _, spacing := hostRefreshLimits(item.host); spacing > 0 {
+			if last, ok := lastStart[item.host]; ok && last.Add(spacing).After(start) {
+				start = last.Add(spacing)
+			}
+			lastStart[item.host] = start
+		}
+		tasks = append(tasks, newRefreshTask(item, false, start))
+	}
+	return tasks
+}
+
+func newRefreshTask(item refreshItem, running bool, start time.Time) RefreshTask {
+	return RefreshTask{
+		URL:      item.entry.URL.String(),
+		Priority: item.priority.String(),
+		Reason:   item.reason.String(),
+		Queued:   item.queued,
+		Running:  running,
+		Start:    start,
+	}
+}
+
+// saved lists the running refreshes, by start time, followed by the queued
+// ones in order, along with the signed params of their entries, so that the
+// entries can be recreated when the refreshes are restored.
+func (q *refreshQueue) saved() []savedRefresh {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]refreshItem, 0, len(q.running)+len(q.items))
+	for _, item := range q.running {
+		items = append(items, item)
+	}
+	slices.SortFunc(items, func(a, b refreshItem) int {
+		return a.started.Compare(b.started)
+	})
+	items = append(items, q.items...)
+
+	saved := make([]savedRefresh, len(items))
+	for i, item := range items {
+		saved[i] = savedRefresh{
+			RefreshTask: newRefreshTask(item, !item.started.IsZero(), item.started),
+			Expire:      item.entry.Expire.Unix(),
+			Signature:   item.entry.Signature,
+			Namespace:   item.entry.Namespace,
+			Tags:        item.entry.Tags,
+		}
+	}
+	return saved
+}
+
+// CancelRefresh removes the queued refresh of the entry at key from the queue.
+// Running refreshes can't be cancelled.
+func (c *Cache) CancelRefresh(key string) error {
+	if err := c.refreshQueue.cancel(key); err != nil {
+		return err
+	}
+	c.endRefresh(key)
+	return nil
+}
+
+// queueHandler lists the queued and running refreshes as JSON, or, for a POST
+// request, cancels or bumps the queued refresh of the URL given by the "url"
+// query param, depending on the "action" query param.
+func queueHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cache.refreshQueue.Tasks())
+	case http.MethodPost:
+		if !isAdmin(req) {
+			http.Error(w, "Admin token required", http.StatusForbidden)
+			return
+		}
+		targetURL, err := url.Parse(req.FormValue("url"))
+		if err != nil || targetURL.String() == "" {
+			http.Error(w, `Query param "url" must be a valid URL`, http.StatusBadRequest)
+			return
+		}
+		key := cacheKey(targetURL)
+
+		action := req.FormValue("action")
+		switch action {
+		case "cancel":
+			err = cache.CancelRefresh(key)
+		case "bump":
+			err = cache.refreshQueue.bump(key)
+		default:
+			http.Error(w, `Query param "action" must be "cancel" or "bump"`, http.StatusBadRequest)
+			return
+		}
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "Refresh %s: %s\n", action, targetURL)
+		}
+		switch {
+		case errors.Is(err, errNotQueued):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errRefreshRunning):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case strings.Contains(req.Referer(), infoPath):
+			http.Redirect(w, req, req.Referer(), http.StatusSeeOther)
+		default:
+			fmt.Fprintf(w, "Refresh %s: %s\n", action, targetURL)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
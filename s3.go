@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// An s3Client talks to a bucket in S3-compatible object storage, such as
+// MinIO, using path-style requests signed with AWS Signature Version 4. It only
+// implements the handful of operations needed by s3Store.
+type s3Client struct {
+	endpoint        *url.URL
+	bucket          string
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	http            *http.Client
+}
+
+// An s3Object is an object found by s3Client.list.
+type s3Object struct {
+	Key          string
+	LastModified time.Time
+}
+
+// An s3Error is an unexpected response from the object storage. Any other
+// error returned by s3Client means that the storage couldn't be reached.
+type s3Error struct {
+	Op     string
+	Status string
+	Body   string
+}
+
+func (e *s3Error) Error() string {
+	return fmt.Sprintf("S3 %s: %s: %s", e.Op, e.Status, e.Body)
+}
+
+func newS3Client(endpoint, bucket, region, accessKeyID, secretAccessKey string) (*s3Client, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("endpoint must be an http or https URL, got %q", endpoint)
+	}
+	return &s3Client{
+		endpoint:        u,
+		bucket:          bucket,
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		http:            &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// get returns the object at key. ok is false if there is no such object.
+func (c *s3Client) get(key string) (content []byte, ok bool, err error) {
+	res, err := c.do(http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		content, err = io.ReadAll(res.Body)
+		return content, err == nil, err
+	case http.StatusNotFound:
+		return nil, false, nil
+	default:
+		return nil, false, responseError("get "+key, res)
+	}
+}
+
+// put stores content at key.
+func (c *s3Client) put(key string, content []byte) error {
+	res, err := c.do(http.MethodPut, key, nil, content)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("put "+key, res)
+	}
+	return nil
+}
+
+// delete removes the object at key. An object that doesn't exist isn't
+// considered an error.
+func (c *s3Client) delete(key string) error {
+	res, err := c.do(http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusNoContent && res.StatusCode != http.StatusOK {
+		return responseError("delete "+key, res)
+	}
+	return nil
+}
+
+// list returns every object whose key starts with prefix.
+func (c *s3Client) list(prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	for {
+		res, err := c.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		if res.StatusCode != http.StatusOK {
+			err = responseError("list "+prefix, res)
+			res.Body.Close()
+			return nil, err
+		}
+		var result struct {
+			Contents              []s3Object
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("S3 list %s: %w", prefix, err)
+		}
+		objects = append(objects, result.Contents...)
+		if !result.IsTruncated {
+			return objects, nil
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+}
+
+// ensureBucket creates the bucket, unless it exists already.
+func (c *s3Client) ensureBucket() error {
+	res, err := c.do(http.MethodHead, "", nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+	default:
+		return responseError("head bucket", res)
+	}
+
+	var body []byte
+	if c.region != "us-east-1" {
+		body = []byte(`<CreateBucketConfiguration xmlns="http://s3.amazonaws.com/doc/2006-03-01/">` +
+			`<LocationConstraint>` + c.region + `</LocationConstraint></CreateBucketConfiguration>`)
+	}
+	if res, err = c.do(http.MethodPut, "", nil, body); err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return responseError("create bucket", res)
+	}
+	return nil
+}
+
+// do sends a signed request for the object at key, or for the bucket itself
+// if key is empty.
+func (c *s3Client) do(method, key string, query url.Values, body []byte) (*http.Response, error) {
+	path := "/" + c.bucket
+	if key != "" {
+		path += "/" + key
+	}
+	u := *c.endpoint
+	u.Path = path
+	u.RawPath = s3Escape(path, false)
+	u.RawQuery = canonicalS3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body, time.Now())
+	return c.http.Do(req)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req, which must
+// have been created by do.
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + payloadHash,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := []byte("AWS4" + c.secretAccessKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKeyID, scope, signedHeaders, signature,
+	))
+}
+
+func responseError(op string, res *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	return &s3Error{Op: op, Status: res.Status, Body: strings.TrimSpace(string(body))}
+}
+
+// canonicalS3Query encodes query the way Signature Version 4 expects it:
+// Sorted by key, and with every reserved character percent-encoded.
+func canonicalS3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	var parts []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes every byte of s except the unreserved characters
+// of RFC 3986, and slashes unless escapeSlash is set.
+func s3Escape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'a' <= ch && ch <= 'z', 'A' <= ch && ch <= 'Z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '.', ch == '_', ch == '~', ch == '/' && !escapeSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
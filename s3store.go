@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// s3RetryInterval is how often an s3Store that has lost its connection checks
+// whether the bucket is reachable again, unless its retryInterval says
+// otherwise.
+const s3RetryInterval = time.Minute
+
+// s3ImageGracePeriod is how old an image in the bucket must be before it's
+// deleted for not being referenced by any entry. Other instances may have
+// uploaded the image but not yet the entry referring to it.
+const s3ImageGracePeriod = time.Hour
+
+// An s3Store is a CacheStore that keeps its entries and images in a bucket in
+// S3-compatible object storage, so that several Spectura instances can share
+// their screenshots. Entries are stored like in a fileStore, as
+// "entries/<hash of key>.json" and "images/<hash>.png" below the configured
+// prefix.
+//
+// Like a fileStore, an s3Store keeps its contents in memory, while changes are
+// written to the bucket in the background, so that the Cache isn't held up by
+// requests to the bucket. Entries written by other instances after startup are
+// read through on a cache miss (see Fetch). Since images in the bucket may
+// still be used by other instances, they aren't deleted along with the local
+// copy; unreferenced images are deleted when an s3Store is opened instead.
+//
+// While the bucket is unreachable, the s3Store works as a memoryStore. The
+// changes made in the meantime are written to the bucket once it's reachable
+// again.
+type s3Store struct {
+	client *s3Client
+	prefix string
+	mem    *memoryStore
+
+	online        atomic.Bool
+	retryInterval time.Duration
+	dirtyMu       sync.Mutex
+	dirtyEntries  map[string]bool
+	dirtyImages   map[string]bool
+	// flushMu serializes flushes, so that older versions of an entry are
+	// never written after newer ones
+	flushMu sync.Mutex
+	// flushes is signalled when changes are marked as dirty
+	flushes chan struct{}
+}
+
+// openS3Store opens the store in the bucket of client, creating the bucket if
+// it doesn't exist, and loads the entries stored below prefix. If the bucket
+// can't be reached, the store starts out empty.
+func openS3Store(client *s3Client, prefix string) *s3Store {
+	s := &s3Store{
+		client:        client,
+		prefix:        prefix,
+		mem:           newMemoryStore(),
+		retryInterval: s3RetryInterval,
+		dirtyEntries:  make(map[string]bool),
+		dirtyImages:   make(map[string]bool),
+		flushes:       make(chan struct{}, 1),
+	}
+	go s.flushChanges()
+	err := client.ensureBucket()
+	if err == nil {
+		err = s.load()
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't load cache from S3 bucket %s, falling back to memory: %s\n", client.bucket, err)
+		go s.reconnect()
+		return s
+	}
+	s.online.Store(true)
+	fmt.Fprintf(os.Stderr, "Loaded %d cache entries from S3 bucket %s\n", s.mem.Len(), client.bucket)
+	return s
+}
+
+func (s *s3Store) entryKey(key string) string {
+	return path.Join(s.prefix, "entries", diskName(key)+".json")
+}
+
+func (s *s3Store) imageKey(hash string) string {
+	return path.Join(s.prefix, "images", hash+".png")
+}
+
+func (s *s3Store) Get(key string) (CacheEntry, bool) {
+	return s.mem.Get(key)
+}
+
+func (s *s3Store) Put(key string, entry CacheEntry) error {
+	s.mem.Put(key, entry)
+	s.markDirty(s.dirtyEntries, key)
+	return nil
+}
+
+func (s *s3Store) Delete(key string) error {
+	s.mem.Delete(key)
+	s.markDirty(s.dirtyEntries, key)
+	return nil
+}
+
+func (s *s3Store) Range(fn func(key string, entry CacheEntry) bool) {
+	s.mem.Range(fn)
+}
+
+func (s *s3Store) Len() int {
+	return s.mem.Len()
+}
+
+func (s *s3Store) GetImage(hash string) ([]byte, bool) {
+	return s.mem.GetImage(hash)
+}
+
+// PutImage stores image and queues its upload, unless an image with the same
+// hash is already stored.
+func (s *s3Store) PutImage(hash string, image []byte) error {
+	if _, exists := s.mem.GetImage(hash); exists {
+		return nil
+	}
+	s.mem.PutImage(hash, image)
+	s.markDirty(s.dirtyImages, hash)
+	return nil
+}
+
+// DeleteImage only deletes the local copy of the image, since other instances
+// may still refer to it.
+func (s *s3Store) DeleteImage(hash string) error {
+	s.mem.DeleteImage(hash)
+	return nil
+}
+
+// Fetch reads the entry at key from the bucket, along with its images, which
+// are kept in memory. The entry itself isn't stored, so that the Cache can
+// store it and account for its images. ok is false if the entry isn't in the
+// bucket or the bucket is unreachable.
+func (s *s3Store) Fetch(key string) (entry CacheEntry, ok bool) {
+	if !s.online.Load() {
+		return CacheEntry{}, false
+	}
+	entry, ok, err := s.fetchEntry(s.entryKey(key))
+	if err == nil && ok {
+		err = s.fetchImages(&entry)
+	}
+	if err != nil {
+		if err = rejected(err); err != nil {
+			s.fail(err)
+		}
+		return CacheEntry{}, false
+	}
+	return entry, ok && entry.Key() == key
+}
+
+// fetchEntry downloads and decodes the entry stored at objectKey.
+func (s *s3Store) fetchEntry(objectKey string) (CacheEntry, bool, error) {
+	content, ok, err := s.client.get(objectKey)
+	if err != nil || !ok {
+		return CacheEntry{}, false, err
+	}
+	var record entryRecord
+	if err = json.Unmarshal(content, &record); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't decode cache entry %s: %s\n", objectKey, err)
+		return CacheEntry{}, false, nil
+	}
+	entry, err := record.entry()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad URL in cache entry %s: %s\n", objectKey, err)
+		return CacheEntry{}, false, nil
+	}
+	return entry, true, nil
+}
+
+// fetchImages downloads the images of entry that aren't in memory yet. Images
+// missing from the bucket are dropped from the entry.
+func (s *s3Store) fetchImages(entry *CacheEntry) error {
+	var missing []string
+	for _, hash := range entry.imageHashes() {
+		if _, exists := s.mem.GetImage(hash); exists {
+			continue
+		}
+		image, ok, err := s.client.get(s.imageKey(hash))
+		if err != nil {
+			return err
+		}
+		if !ok || imageHash(image) != hash {
+			fmt.Fprintf(os.Stderr, "Couldn't find image %s for %s in S3 bucket\n", hash, entry.URL)
+			missing = append(missing, hash)
+			continue
+		}
+		s.mem.PutImage(hash, image)
+	}
+	if slices.Contains(missing, entry.ImageHash) {
+		entry.ImageHash = ""
+	}
+	entry.Versions = slices.DeleteFunc(entry.Versions, func(v ImageVersion) bool {
+		return slices.Contains(missing, v.ImageHash)
+	})
+	return nil
+}
+
+func (s *s3Store) uploadEntry(key string, entry CacheEntry) error {
+	content, err := json.Marshal(newEntryRecord(entry))
+	if err != nil {
+		return err
+	}
+	return s.client.put(s.entryKey(key), content)
+}
+
+// markDirty adds id to dirty, so that the change is written to the bucket by
+// flushChanges.
+func (s *s3Store) markDirty(dirty map[string]bool, id string) {
+	s.dirtyMu.Lock()
+	dirty[id] = true
+	s.dirtyMu.Unlock()
+	select {
+	case s.flushes <- struct{}{}:
+	default:
+	}
+}
+
+// Flush writes the pending changes to the bucket, even if it was unreachable
+// the last time it was tried. The changes that couldn't be written are kept.
+func (s *s3Store) Flush() error {
+	return s.flush()
+}
+
+// flushChanges writes the changes marked as dirty to the bucket while it's
+// reachable. While it isn't, the changes are kept until reconnect writes them.
+func (s *s3Store) flushChanges() {
+	for range s.flushes {
+		if !s.online.Load() {
+			continue
+		}
+		if err := s.flush(); err != nil {
+			s.fail(err)
+		}
+	}
+}
+
+// fail switches the store to memory only, after err showed that the bucket is
+// unreachable, and starts trying to reconnect.
+func (s *s3Store) fail(err error) {
+	if s.online.CompareAndSwap(true, false) {
+		fmt.Fprintf(os.Stderr, "Lost connection to S3 bucket %s, falling back to memory: %s\n", s.client.bucket, err)
+		go s.reconnect()
+	}
+}
+
+// reconnect waits until the bucket is reachable again, and then writes the
+// changes made while it wasn't.
+func (s *s3Store) reconnect() {
+	for {
+		time.Sleep(s.retryInterval)
+		if err := s.client.ensureBucket(); err != nil {
+			continue
+		}
+		if err := s.flush(); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write cache changes to S3 bucket %s: %s\n", s.client.bucket, err)
+			continue
+		}
+		s.online.Store(true)
+		fmt.Fprintf(os.Stderr, "Reconnected to S3 bucket %s\n", s.client.bucket)
+		// Changes made while flushing are written by flushChanges
+		select {
+		case s.flushes <- struct{}{}:
+		default:
+		}
+		return
+	}
+}
+
+// flush writes the changes recorded in the dirty sets to the bucket. Images
+// are written first, so that entries never refer to images that aren't in the
+// bucket. Changes the bucket rejects are logged and dropped, while an error
+// reaching the bucket stops the flush and is returned.
+func (s *s3Store) flush() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	s.dirtyMu.Lock()
+	images, entries := maps.Clone(s.dirtyImages), maps.Clone(s.dirtyEntries)
+	clear(s.dirtyImages)
+	clear(s.dirtyEntries)
+	s.dirtyMu.Unlock()
+
+	var err error
+	for hash := range images {
+		if err != nil {
+			break
+		}
+		if image, exists := s.mem.GetImage(hash); exists {
+			err = rejected(s.client.put(s.imageKey(hash), image))
+		}
+		if err == nil {
+			delete(images, hash)
+		}
+	}
+	for key := range entries {
+		if err != nil {
+			break
+		}
+		if entry, exists := s.mem.Get(key); exists {
+			err = rejected(s.uploadEntry(key, entry))
+		} else {
+			err = rejected(s.client.delete(s.entryKey(key)))
+		}
+		if err == nil {
+			delete(entries, key)
+		}
+	}
+	if err != nil {
+		// Keep what's left for the next attempt
+		s.dirtyMu.Lock()
+		for hash := range images {
+			s.dirtyImages[hash] = true
+		}
+		for key := range entries {
+			s.dirtyEntries[key] = true
+		}
+		s.dirtyMu.Unlock()
+	}
+	return err
+}
+
+// rejected logs err and returns nil if it's an error response from the bucket,
+// which retrying won't fix. Other errors are returned.
+func rejected(err error) error {
+	var respErr *s3Error
+	if errors.As(err, &respErr) {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		return nil
+	}
+	return err
+}
+
+// load reads every entry stored in the bucket along with the images they refer
+// to. Entries that are due to be evicted are deleted instead of being loaded,
+// and so are images that no entry refers to, once they are older than
+// s3ImageGracePeriod.
+func (s *s3Store) load() error {
+	objects, err := s.client.list(path.Join(s.prefix, "entries") + "/")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		if !strings.HasSuffix(object.Key, ".json") {
+			continue
+		}
+		entry, ok, err := s.fetchEntry(object.Key)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		key := entry.Key()
+		if entry.IsEvictable() && !entry.IsProtected() {
+			if err = s.client.delete(object.Key); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = s.fetchImages(&entry); err != nil {
+			return err
+		}
+		// The key changes if the canonicalization options have changed
+		if s.entryKey(key) != object.Key {
+			if err = s.uploadEntry(key, entry); err != nil {
+				return err
+			}
+			if err = s.client.delete(object.Key); err != nil {
+				return err
+			}
+		}
+		s.mem.Put(key, entry)
+	}
+
+	objects, err = s.client.list(path.Join(s.prefix, "images") + "/")
+	if err != nil {
+		return err
+	}
+	for _, object := range objects {
+		hash, ok := strings.CutSuffix(path.Base(object.Key), ".png")
+		if !ok || time.Since(object.LastModified) < s3ImageGracePeriod {
+			continue
+		}
+		if _, referenced := s.mem.GetImage(hash); !referenced {
+			if err = s.client.delete(object.Key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
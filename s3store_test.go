@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A fakeS3 serves a single bucket over the subset of the S3 API used by
+// s3Client. While it's down, connections are closed without a response.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	created bool
+	down    bool
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		conn.Close()
+		return
+	}
+	if !strings.HasPrefix(req.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+		http.Error(w, "AccessDenied", http.StatusForbidden)
+		return
+	}
+	_, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/bucket"), "/")
+	switch {
+	case req.Method == http.MethodHead && key == "":
+		if !f.created {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case req.Method == http.MethodPut && key == "":
+		f.created = true
+	case req.Method == http.MethodGet && key == "":
+		fmt.Fprint(w, "<ListBucketResult><IsTruncated>false</IsTruncated>")
+		for k := range f.objects {
+			if strings.HasPrefix(k, req.URL.Query().Get("prefix")) {
+				fmt.Fprint(w, "<Contents><Key>")
+				xml.EscapeText(w, []byte(k))
+				fmt.Fprintf(w, "</Key><LastModified>%s</LastModified></Contents>", time.Now().UTC().Format(time.RFC3339))
+			}
+		}
+		fmt.Fprint(w, "</ListBucketResult>")
+	case req.Method == http.MethodGet:
+		content, ok := f.objects[key]
+		if !ok {
+			http.Error(w, "NoSuchKey", http.StatusNotFound)
+			return
+		}
+		w.Write(content)
+	case req.Method == http.MethodPut:
+		f.objects[key], _ = io.ReadAll(req.Body)
+	case req.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (f *fakeS3) setDown(down bool) {
+	f.mu.Lock()
+	f.down = down
+	f.mu.Unlock()
+}
+
+func (f *fakeS3) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.objects[key]
+	return ok
+}
+
+// newFakeS3 starts a fakeS3 and returns it along with a client for it.
+func newFakeS3(t *testing.T) (*fakeS3, *s3Client) {
+	fake := &fakeS3{objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	client, err := newS3Client(server.URL, "bucket", "us-east-1", "test", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fake, client
+}
+
+// eventually waits for cond to become true, failing the test if it doesn't
+// within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+func TestS3StoreReadThrough(t *testing.T) {
+	setGlobal(t, &cacheTTL, time.Hour)
+	fake, client := newFakeS3(t)
+	writer, reader := &Cache{}, &Cache{}
+	writer.initStore(openS3Store(client, "spectura"))
+	store := openS3Store(client, "spectura")
+	reader.initStore(store)
+
+	entry := testEntry("https://example.com/ad", "image")
+	writer.Write(entry)
+	eventually(t, "entry upload", func() bool {
+		return fake.has(store.entryKey(entry.Key()))
+	})
+
+	got := reader.Read(entry.Key())
+	if got.ImageHash != entry.ImageHash || string(got.Image) != "image" {
+		t.Fatalf("Read() = %.8s with image %q, want %.8s with image %q", got.ImageHash, got.Image, entry.ImageHash, "image")
+	}
+	if _, ok := reader.ReadImage(entry.ImageHash); !ok {
+		t.Error("image of read-through entry isn't retained")
+	}
+	other := testEntry("https://example.com/other", "")
+	if got = reader.Read(other.Key()); !got.IsEmpty() {
+		t.Errorf("Read() of an uncached URL = %s, want an empty entry", got.URL)
+	}
+}
+
+func TestS3StoreReconnect(t *testing.T) {
+	setGlobal(t, &cacheTTL, time.Hour)
+	fake, client := newFakeS3(t)
+	store := openS3Store(client, "spectura")
+	store.retryInterval = 10 * time.Millisecond
+	c := &Cache{}
+	c.initStore(store)
+
+	fake.setDown(true)
+	entry := testEntry("https://example.com/ad", "image")
+	c.Write(entry)
+	eventually(t, "store to go offline", func() bool { return !store.online.Load() })
+	if _, ok := store.Fetch(entry.Key()); ok {
+		t.Error("Fetch() succeeded while offline")
+	}
+
+	fake.setDown(false)
+	eventually(t, "store to reconnect", store.online.Load)
+	eventually(t, "changes to be flushed", func() bool {
+		return fake.has(store.entryKey(entry.Key())) && fake.has(store.imageKey(entry.ImageHash))
+	})
+
+	// A new instance loads what was flushed
+	loaded := openS3Store(client, "spectura")
+	if got, ok := loaded.Get(entry.Key()); !ok || got.ImageHash != entry.ImageHash {
+		t.Errorf("loaded entry = %.8s (found %t), want %.8s", got.ImageHash, ok, entry.ImageHash)
+	}
+}
+
+func TestS3StoreFlush(t *testing.T) {
+	fake, client := newFakeS3(t)
+	store := openS3Store(client, "spectura")
+	c := &Cache{}
+	c.initStore(store)
+
+	entry := testEntry("https://example.com/ad", "image")
+	c.Write(entry)
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.has(store.entryKey(entry.Key())) || !fake.has(store.imageKey(entry.ImageHash)) {
+		t.Error("Flush() returned before the changes were written")
+	}
+
+	fake.setDown(true)
+	c.Write(testEntry("https://example.com/other", "other"))
+	if err := c.Flush(); err == nil {
+		t.Error("Flush() succeeded while the bucket was down")
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// shutdown stops server gracefully: It stops taking refreshes from the queue
+// and accepting new requests, waits for the requests and refreshes in progress
+// to finish, writes the cache changes still pending in the store, and waits
+// for the webhooks in progress, all within shutdownTimeout. The refreshes
+// still queued or running are then saved to queueStateFile, so that they can
+// be queued again on the next start (see restoreRefreshQueue).
+func shutdown(server *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	cache.refreshQueue.close()
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't finish pending requests: %s\n", err)
+	}
+	if !wait(ctx, &cache.tasks) {
+		fmt.Fprintf(os.Stderr, "Couldn't finish running refreshes: %s\n", ctx.Err())
+	}
+	flushed := make(chan error, 1)
+	go func() { flushed <- cache.Flush() }()
+	select {
+	case err := <-flushed:
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't write pending cache changes: %s\n", err)
+		}
+	case <-ctx.Done():
+		fmt.Fprintf(os.Stderr, "Couldn't write pending cache changes: %s\n", ctx.Err())
+	}
+	if !wait(ctx, &webhooks) {
+		fmt.Fprintf(os.Stderr, "Couldn't deliver pending webhooks: %s\n", ctx.Err())
+	}
+
+	if queueStateFile == "" {
+		return
+	}
+	tasks := cache.refreshQueue.saved()
+	if err := saveRefreshQueue(queueStateFile, tasks); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't save refresh queue to %s: %s\n", queueStateFile, err)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Saved %d refreshes to %s\n", len(tasks), queueStateFile)
+}
+
+// wait waits for wg, or until ctx is done. It reports whether wg is done.
+func wait(ctx context.Context, wg *sync.WaitGroup) bool {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// A savedRefresh is a refresh saved to queueStateFile. Along with the task, it
+// holds the expire, signature, namespace and tags of the entry, so that the
+// entry can be recreated if the store didn't keep it, as with the memory
+// backend.
+type savedRefresh struct {
+	RefreshTask
+	Expire    int64    `json:"expire"`
+	Signature string   `json:"s"`
+	Namespace string   `json:"ns,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+}
+
+func saveRefreshQueue(path string, tasks []savedRefresh) error {
+	content, err := json.Marshal(tasks)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, content)
+}
+
+// restoreRefreshQueue queues the refreshes saved to path on shutdown again,
+// with the same priority, and removes the file. Entries that are no longer
+// cached are recreated from the saved params, and only cached once they have
+// been captured (see queueRefresh), unless they have expired, in which case
+// their refreshes are skipped.
+func restoreRefreshQueue(path string) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	var tasks []savedRefresh
+	if err == nil {
+		err = json.Unmarshal(content, &tasks)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't restore refresh queue from %s: %s\n", path, err)
+		return
+	}
+	queued := 0
+	for _, task := range tasks {
+		targetURL, err := url.Parse(task.URL)
+		priority := slices.Index(priorityNames, task.Priority)
+		if err != nil || priority < 0 {
+			continue
+		}
+		entry := cache.Read(cacheKey(targetURL))
+		if entry.IsEmpty() {
+			entry = CacheEntry{
+				Expire:    time.Unix(task.Expire, 0),
+				Signature: task.Signature,
+				URL:       targetURL,
+				Namespace: task.Namespace,
+				Tags:      task.Tags,
+			}
+			if task.Expire == 0 || time.Now().After(entry.Expire) {
+				continue
+			}
+		}
+		if cache.queueRefresh(entry, RefreshPriority(priority)) == nil {
+			queued++
+		}
+	}
+	fmt.Fprintf(os.Stderr, "Restored %d of %d refreshes from %s\n", queued, len(tasks), path)
+	if err = removeFile(path); err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't remove %s: %s\n", path, err)
+	}
+}
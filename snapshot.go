@@ -0,0 +1,219 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A snapshot is a tar archive holding the contents of a Cache. It contains a
+// JSON manifest, "manifest.json", listing every entry as an entryRecord,
+// followed by the images referred to by the entries, stored as
+// "images/<hash>.png".
+const snapshotManifest = "manifest.json"
+
+// Export writes a snapshot of every entry in the cache to w.
+func (c *Cache) Export(w io.Writer) error {
+	entries := c.ReadAll()
+	records := make([]entryRecord, len(entries))
+	for i, entry := range entries {
+		records[i] = newEntryRecord(entry)
+	}
+	manifest, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	now := time.Now()
+	if err = writeTarFile(tw, snapshotManifest, manifest, now); err != nil {
+		return err
+	}
+	written := make(map[string]bool)
+	for _, entry := range entries {
+		for _, hash := range entry.imageHashes() {
+			if written[hash] {
+				continue
+			}
+			written[hash] = true
+			image, ok := c.ReadImage(hash)
+			if !ok {
+				// The image was deleted after the entries were read
+				continue
+			}
+			name := path.Join("images", hash+".png")
+			if err = writeTarFile(tw, name, image, now); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte, modTime time.Time) error {
+	hdr := &tar.Header{
+		Name:    name,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: modTime,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// Import reads a snapshot from r and writes its entries to the cache, where
+// they are merged with any existing entries (see merge). It returns the number
+// of imported entries.
+func (c *Cache) Import(r io.Reader) (int, error) {
+	var records []entryRecord
+	images := make(map[string][]byte)
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		switch {
+		case hdr.Name == snapshotManifest:
+			if err = json.NewDecoder(tr).Decode(&records); err != nil {
+				return 0, fmt.Errorf("couldn't decode manifest: %w", err)
+			}
+		case strings.HasPrefix(hdr.Name, "images/"):
+			hash := strings.TrimSuffix(path.Base(hdr.Name), ".png")
+			image, err := io.ReadAll(io.LimitReader(tr, int64(maxImageSize)+1))
+			if err != nil {
+				return 0, err
+			}
+			if imageHash(image) != hash {
+				fmt.Fprintf(os.Stderr, "Skipping corrupt image in snapshot: %s\n", hdr.Name)
+				continue
+			}
+			images[hash] = image
+		}
+	}
+	if records == nil {
+		return 0, fmt.Errorf("snapshot has no %s", snapshotManifest)
+	}
+
+	imported := 0
+	for _, record := range records {
+		entry, err := record.entry()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping snapshot entry with bad URL %q: %s\n", record.URL, err)
+			continue
+		}
+		if entry.ImageHash != "" {
+			if entry.Image = images[entry.ImageHash]; entry.Image == nil {
+				entry.ImageHash = ""
+			}
+		}
+		entry.Versions = slices.DeleteFunc(entry.Versions, func(v ImageVersion) bool {
+			return images[v.ImageHash] == nil
+		})
+		c.write(entry, images)
+		imported++
+	}
+	return imported, nil
+}
+
+func snapshotHandler(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		name := fmt.Sprintf("spectura-%s.tar", time.Now().Format("20060102-150405"))
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, name))
+		if err := cache.Export(w); err != nil {
+			fmt.Fprintf(os.Stderr, "Snapshot export failed: %s\n", err)
+		}
+	case http.MethodPost:
+		n, err := cache.Import(req.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Snapshot import failed: %s", err), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d cache entries from snapshot\n", n)
+		fmt.Fprintf(w, "Imported %d entries\n", n)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// snapshotCommand implements the "export" and "import" subcommands, which
+// download a snapshot from, or upload a snapshot to, a running Spectura.
+func snapshotCommand(name string, args []string) error {
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	server := flags.String("server", fmt.Sprintf("http://localhost:%d", port), "address of the Spectura server")
+	token := flags.String("token", os.Getenv("ADMIN_TOKEN"), "admin token (defaults to $ADMIN_TOKEN)")
+	file := flags.String("f", "-", `snapshot file ("-" for stdout/stdin)`)
+	flags.Parse(args)
+
+	u, err := url.Parse(*server + snapshotPath)
+	if err != nil {
+		return err
+	}
+	u.RawQuery = url.Values{"token": {*token}}.Encode()
+
+	var res *http.Response
+	switch name {
+	case "export":
+		out := os.Stdout
+		if *file != "-" {
+			if out, err = os.Create(*file); err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		if res, err = http.Get(u.String()); err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			msg, _ := io.ReadAll(res.Body)
+			return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+		}
+		if _, err = io.Copy(out, res.Body); err != nil {
+			return err
+		}
+		return out.Close()
+	case "import":
+		in := os.Stdin
+		if *file != "-" {
+			if in, err = os.Open(*file); err != nil {
+				return err
+			}
+			defer in.Close()
+		}
+		if res, err = http.Post(u.String(), "application/x-tar", in); err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		msg, _ := io.ReadAll(res.Body)
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(msg)))
+		}
+		fmt.Fprint(os.Stderr, string(msg))
+		return nil
+	}
+	return fmt.Errorf("unknown command %q", name)
+}
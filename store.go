@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"sync"
+)
+
+// A CacheStore is the storage backend of a Cache, holding CacheEntry values by
+// cache key. Images are stored separately from the entries, keyed by their
+// content hash (see imageHash), so that identical screenshots are only stored
+// once. Stored entries refer to their image through ImageHash and have a nil
+// Image. Implementations must be safe for concurrent use; the Cache serializes
+// writes, but reads may happen concurrently with each other and with writes.
+type CacheStore interface {
+	// Get returns the entry stored at key, and whether it was found.
+	Get(key string) (CacheEntry, bool)
+	// Put stores entry at key, replacing any existing entry.
+	Put(key string, entry CacheEntry) error
+	// Delete removes the entry stored at key, if any.
+	Delete(key string) error
+	// Range calls fn for each stored entry until fn returns false. It is safe
+	// to call other methods, including Delete, from fn.
+	Range(fn func(key string, entry CacheEntry) bool)
+	// Len returns the number of stored entries.
+	Len() int
+
+	// GetImage returns the image stored at hash, and whether it was found.
+	GetImage(hash string) ([]byte, bool)
+	// PutImage stores image at hash.
+	PutImage(hash string, image []byte) error
+	// DeleteImage removes the image stored at hash, if any.
+	DeleteImage(hash string) error
+}
+
+// A remoteStore is a CacheStore shared with other Spectura instances.
+type remoteStore interface {
+	CacheStore
+	// Fetch returns an entry stored by another instance at key, without
+	// storing it locally. Its images must be available through GetImage
+	// afterwards.
+	Fetch(key string) (CacheEntry, bool)
+}
+
+// A flusher is a CacheStore that writes changes to its storage in the
+// background. Flush writes the pending changes, and returns once they are
+// written or couldn't be.
+type flusher interface {
+	Flush() error
+}
+
+// imageHash returns the content hash used as the key of image in a
+// CacheStore.
+func imageHash(image []byte) string {
+	sum := sha256.Sum256(image)
+	return hex.EncodeToString(sum[:])
+}
+
+// newCacheStore returns a CacheStore for the named backend.
+func newCacheStore(backend string) (CacheStore, error) {
+	switch backend {
+	case "memory":
+		return newMemoryStore(), nil
+	case "fs":
+		if cacheDir == "" {
+			return nil, fmt.Errorf(`cache backend "fs" requires CACHE_DIR`)
+		}
+		return openFileStore(cacheDir)
+	case "s3":
+		client, err := newS3Client(s3Endpoint, s3Bucket, s3Region, s3AccessKeyID, s3SecretAccessKey)
+		if err != nil {
+			return nil, fmt.Errorf("S3_ENDPOINT: %w", err)
+		}
+		return openS3Store(client, s3Prefix), nil
+	default:
+		return nil, fmt.Errorf("unknown cache backend %q", backend)
+	}
+}
+
+// A memoryStore is a CacheStore that keeps its entries and images in maps.
+type memoryStore struct {
+	mu      sync.RWMutex
+	entries map[string]CacheEntry
+	images  map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		entries: make(map[string]CacheEntry),
+		images:  make(map[string][]byte),
+	}
+}
+
+func (s *memoryStore) Get(key string) (CacheEntry, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	entry, ok := s.entries[key]
+	return entry, ok
+}
+
+func (s *memoryStore) Put(key string, entry CacheEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.entries[key] = entry
+	return nil
+}
+
+func (s *memoryStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// Range calls fn on a copy of the entries, so that fn can modify the store.
+func (s *memoryStore) Range(fn func(key string, entry CacheEntry) bool) {
+	s.mu.RLock()
+	entries := maps.Clone(s.entries)
+	s.mu.RUnlock()
+	for key, entry := range entries {
+		if !fn(key, entry) {
+			return
+		}
+	}
+}
+
+func (s *memoryStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.entries)
+}
+
+func (s *memoryStore) GetImage(hash string) ([]byte, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	image, ok := s.images[hash]
+	return image, ok
+}
+
+func (s *memoryStore) PutImage(hash string, image []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.images[hash] = image
+	return nil
+}
+
+func (s *memoryStore) DeleteImage(hash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.images, hash)
+	return nil
+}
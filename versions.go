@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var errVersionNotFound = errors.New("no such image version")
+
+// CropParams records how a screenshot was cropped into an Open Graph image.
+// The offsets are in pixels of the screenshot, which is scalingFactor times
+// larger than the rendered page.
+type CropParams struct {
+	Voffset   int
+	TopMargin int
+}
+
+// An ImageVersion is an image that has been used by a CacheEntry.
+type ImageVersion struct {
+	ImageHash    string
+	Score        int
+	ImageCreated time.Time
+	Crop         CropParams
+}
+
+// CurrentVersion returns the image currently used by e as an ImageVersion.
+func (e *CacheEntry) CurrentVersion() ImageVersion {
+	return ImageVersion{e.ImageHash, e.Score, e.ImageCreated, e.Crop}
+}
+
+// setVersion makes v the current image of e, pushing the previous image onto
+// the version history.
+func (e *CacheEntry) setVersion(v ImageVersion) {
+	if e.ImageHash != "" {
+		e.Versions = slices.Insert(e.Versions, 0, e.CurrentVersion())
+	}
+	// An image that's current doesn't also belong in the history
+	e.Versions = slices.DeleteFunc(e.Versions, func(old ImageVersion) bool {
+		return old.ImageHash == v.ImageHash
+	})
+	if len(e.Versions) > imageHistorySize {
+		e.Versions = e.Versions[:imageHistorySize]
+	}
+	e.ImageHash, e.Score, e.ImageCreated, e.Crop = v.ImageHash, v.Score, v.ImageCreated, v.Crop
+}
+
+// imageHashes returns the hashes of every image referenced by e, i.e. the
+// current image and the ones in its version history.
+func (e *CacheEntry) imageHashes() []string {
+	var hashes []string
+	if e.ImageHash != "" {
+		hashes = append(hashes, e.ImageHash)
+	}
+	for _, v := range e.Versions {
+		hashes = append(hashes, v.ImageHash)
+	}
+	return hashes
+}
+
+// Rollback makes the image version identified by hash the current image of
+// the entry at key. The image it replaces is kept in the version history.
+func (c *Cache) Rollback(key, hash string) error {
+	var entry CacheEntry
+	err := errVersionNotFound
+	found := c.update(key, func(e *CacheEntry) bool {
+		i := slices.IndexFunc(e.Versions, func(v ImageVersion) bool {
+			return v.ImageHash == hash
+		})
+		if i < 0 {
+			return false
+		}
+		e.setVersion(e.Versions[i])
+		entry, err = *e, nil
+		return true
+	})
+	if !found {
+		return errNotCached
+	}
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "Rolled back %s to image %s\n", key, hash)
+		sendWebhook("image_updated", entry)
+	}
+	return err
+}
+
+// versionsHandler lists the image versions of a cache entry as JSON, or, for a
+// POST request, rolls the entry back to the version given by the "version"
+// query param.
+func versionsHandler(w http.ResponseWriter, req *http.Request) {
+	if !isAdmin(req) {
+		http.Error(w, "Admin token required", http.StatusForbidden)
+		return
+	}
+	targetURL, err := url.Parse(req.FormValue("url"))
+	if err != nil || targetURL.String() == "" {
+		http.Error(w, `Query param "url" must be a valid URL`, http.StatusBadRequest)
+		return
+	}
+	key := cacheKey(targetURL)
+
+	switch req.Method {
+	case http.MethodGet:
+		entry := cache.Read(key)
+		if entry.IsEmpty() {
+			http.Error(w, errNotCached.Error(), http.StatusNotFound)
+			return
+		}
+		versions := entry.Versions
+		if entry.ImageHash != "" {
+			versions = slices.Insert(versions, 0, entry.CurrentVersion())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+	case http.MethodPost:
+		err = cache.Rollback(key, req.FormValue("version"))
+		switch {
+		case errors.Is(err, errNotCached) || errors.Is(err, errVersionNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		case strings.Contains(req.Referer(), infoPath):
+			http.Redirect(w, req, req.Referer(), http.StatusSeeOther)
+		default:
+			fmt.Fprintf(w, "Rolled back to %s\n", req.FormValue("version"))
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// imageHandler serves the image with the hash given by the "hash" query param.
+// It lets the info page show old image versions.
+func imageHandler(w http.ResponseWriter, req *http.Request) {
+	image, ok := cache.ReadImage(req.URL.Query().Get("hash"))
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(image)
+}
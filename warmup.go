@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A warmupItem is a URL to capture during warm-up, along with the expire,
+// signature, namespace and tags query params a screenshot request for it would
+// carry.
+type warmupItem struct {
+	URL       string      `json:"url"`
+	Expire    json.Number `json:"expire"`
+	Signature string      `json:"s"`
+	Namespace string      `json:"ns"`
+	Tags      string      `json:"tags"`
+}
+
+// WarmupProgress reports how far the warm-up has come. Dropped counts the URLs
+// that didn't fit in the refresh queue. The counters are safe for concurrent
+// use, while File must be set before warm-up starts.
+type WarmupProgress struct {
+	File     string
+	Total    atomic.Int64
+	Enqueued atomic.Int64
+	Skipped  atomic.Int64
+	Invalid  atomic.Int64
+	Dropped  atomic.Int64
+	Done     atomic.Bool
+}
+
+var warmup WarmupProgress
+
+// String summarizes the progress for the info page.
+func (p *WarmupProgress) String() string {
+	state := "in progress"
+	if p.Done.Load() {
+		state = "done"
+	}
+	return fmt.Sprintf("%s: %d of %d URLs enqueued, %d already cached, %d invalid, %d dropped by the full refresh queue (%s)",
+		p.File, p.Enqueued.Load(), p.Total.Load(), p.Skipped.Load(), p.Invalid.Load(), p.Dropped.Load(), state)
+}
+
+// readWarmupFile reads the URLs to warm up the cache with. Each line of the
+// file is either a JSON object with the fields "url", "expire" and "s", and
+// optionally "ns" and "tags", or a URL followed by its expire and signature,
+// separated by whitespace. Empty lines and lines starting with # are ignored.
+func readWarmupFile(path string) ([]warmupItem, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var items []warmupItem
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var item warmupItem
+		if strings.HasPrefix(line, "{") {
+			if err = json.Unmarshal([]byte(line), &item); err != nil {
+				return nil, fmt.Errorf("line %d: %w", n, err)
+			}
+		} else {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("line %d: expected a URL and an expire time", n)
+			}
+			item.URL, item.Expire = fields[0], json.Number(fields[1])
+			if len(fields) > 2 {
+				item.Signature = fields[2]
+			}
+		}
+		items = append(items, item)
+	}
+	return items, scanner.Err()
+}
+
+// warmUp enqueues refreshes for the URLs in path through the regular refresh
+// machinery, one every warmupInterval, so that the cache is warm before
+// crawlers start asking for screenshots. URLs that are already cached are
+// skipped, as are URLs with a bad signature or an expire time in the past.
+// The URLs are only cached once they have been captured, so URLs dropped
+// because the refresh queue is full are captured on their first request.
+func warmUp(path string) {
+	items, err := readWarmupFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Couldn't read warm-up file %s: %s\n", path, err)
+		warmup.Done.Store(true)
+		return
+	}
+	warmup.Total.Store(int64(len(items)))
+	fmt.Fprintf(os.Stderr, "Warming up cache with %d URLs from %s\n", len(items), path)
+
+	for _, item := range items {
+		entry, err := item.entry()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping warm-up URL %s: %s\n", item.URL, err)
+			warmup.Invalid.Add(1)
+			continue
+		}
+		if cached := cache.Read(entry.Key()); !cached.IsEmpty() && !cached.IsFailedImage() {
+			warmup.Skipped.Add(1)
+			continue
+		}
+		if err = cache.queueRefresh(entry, PriorityAuto); err != nil {
+			fmt.Fprintf(os.Stderr, "Couldn't enqueue warm-up URL %s: %s\n", item.URL, err)
+			warmup.Dropped.Add(1)
+		} else {
+			warmup.Enqueued.Add(1)
+		}
+		time.Sleep(warmupInterval)
+	}
+	warmup.Done.Store(true)
+	fmt.Fprintf(os.Stderr, "Warm-up done: %d enqueued, %d skipped, %d invalid, %d dropped\n",
+		warmup.Enqueued.Load(), warmup.Skipped.Load(), warmup.Invalid.Load(), warmup.Dropped.Load())
+}
+
+// entry validates item the same way screenshotHandler validates a request,
+// and returns a CacheEntry for it.
+func (item warmupItem) entry() (CacheEntry, error) {
+	expire, err := strconv.ParseInt(item.Expire.String(), 10, 64)
+	if err != nil {
+		return CacheEntry{}, fmt.Errorf("expire must be a number")
+	}
+	targetURL, err := url.Parse(item.URL)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	tags, err := parseTags(item.Tags)
+	if err != nil {
+		return CacheEntry{}, err
+	}
+	signed := signedURL(targetURL.String(), item.Namespace, item.Tags)
+	if useSignatures && !checkSignature(signed, item.Signature, item.Expire.String()) {
+		return CacheEntry{}, fmt.Errorf("signature check failed")
+	}
+	if time.Now().After(time.Unix(expire, 0)) {
+		return CacheEntry{}, fmt.Errorf("expired")
+	}
+	return CacheEntry{
+		Expire:    time.Unix(expire, 0),
+		Signature: item.Signature,
+		URL:       targetURL,
+		Namespace: item.Namespace,
+		Tags:      tags,
+	}, nil
+}
@@ -43,6 +43,9 @@ func FmtByteSize(n, prec int) string {
 	if n < 1 {
 		return "0 B"
 	}
+	if n < 1<<10 {
+		return fmt.Sprintf("%d B", n)
+	}
 	exp := (bits.Len(uint(n)) - 1) / 10
 	factor := float64(n) / float64(uint(1)<<(10*exp))
 	for prec < 4 {